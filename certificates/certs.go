@@ -10,6 +10,7 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"os"
 	"time"
@@ -17,49 +18,104 @@ import (
 	"github.com/pkg/errors"
 )
 
-func GenerateCert(ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, serialNumber int64, subject string, notBefore time.Time, notAfter time.Time) (*pem.Block, *pem.Block, error) {
+func GenerateCert(role string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, serialNumber int64, subject string, notBefore time.Time, notAfter time.Time) (*pem.Block, *pem.Block, error) {
+	template, err := certificateTemplate(role, serialNumber, subject, notBefore, notAfter)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "failed to generate private key")
 	}
 
-	template := x509.Certificate{
+	signingKey := parentKey
+
+	if parent == nil {
+		parent = template
+		signingKey = key
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signingKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to create certificate")
+	}
+
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to marshal ecdsa")
+	}
+	return &pem.Block{Type: "CERTIFICATE", Bytes: cert},
+		&pem.Block{Type: "ECDSA PRIVATE KEY", Bytes: b},
+		nil
+}
+
+// SignCSR issues a certificate with role for the key in csr. The subject
+// comes from the caller, whatever the request asks for.
+func SignCSR(csr *x509.CertificateRequest, role string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, serialNumber int64, subject string, notBefore time.Time, notAfter time.Time) (*pem.Block, error) {
+	err := csr.CheckSignature()
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid CSR signature")
+	}
+
+	publicKey, ok := csr.PublicKey.(*ecdsa.PublicKey)
+	if !ok || publicKey.Curve != elliptic.P256() {
+		return nil, errors.New("CSR key must be ECDSA P-256")
+	}
+
+	template, err := certificateTemplate(role, serialNumber, subject, notBefore, notAfter)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, parentKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create certificate")
+	}
+
+	return &pem.Block{Type: "CERTIFICATE", Bytes: cert}, nil
+}
+
+func certificateTemplate(role string, serialNumber int64, subject string, notBefore time.Time, notAfter time.Time) (*x509.Certificate, error) {
+	extKeyUsage, err := extKeyUsage(role)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
 		SerialNumber:          new(big.Int).SetInt64(serialNumber),
-		Subject:               pkix.Name{CommonName: subject},
+		Subject:               pkix.Name{CommonName: subject, OrganizationalUnit: []string{role}},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		ExtKeyUsage:           extKeyUsage,
 		BasicConstraintsValid: true,
 	}
 
 	template.DNSNames = []string{subject}
 
-	if ca {
+	switch role {
+	case RoleCA:
 		template.IsCA = true
 		template.KeyUsage |= x509.KeyUsageCertSign
 		template.KeyUsage |= x509.KeyUsageCRLSign
+	case RoleSigner:
+		// can only sign end certificates, limited to its own key usages
+		template.IsCA = true
+		template.MaxPathLenZero = true
+		template.KeyUsage |= x509.KeyUsageCertSign
 	}
 
-	signingKey := parentKey
-
-	if parent == nil {
-		parent = &template
-		signingKey = key
-	}
+	return template, nil
+}
 
-	cert, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, signingKey)
+func RandomSerial() (int64, error) {
+	bn, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "Failed to create certificate")
+		return 0, errors.Wrap(err, "could not create random serial")
 	}
 
-	b, err := x509.MarshalECPrivateKey(key)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to marshal ecdsa")
-	}
-	return &pem.Block{Type: "CERTIFICATE", Bytes: cert},
-		&pem.Block{Type: "ECDSA PRIVATE KEY", Bytes: b},
-		nil
+	return bn.Int64(), nil
 }
 
 func ReadCert(path string, withKey bool) (*x509.Certificate, *ecdsa.PrivateKey, error) {
@@ -100,7 +156,45 @@ func ReadCert(path string, withKey bool) (*x509.Certificate, *ecdsa.PrivateKey,
 	return xcert, xkey, nil
 }
 
-func WriteCertToFile(path string, crt *pem.Block, key *pem.Block) error {
+// ReadChain returns the certificates following the first one in path, the
+// intermediates a node presents along with its own certificate
+func ReadChain(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []*x509.Certificate
+	first := true
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return chain, nil
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		if first {
+			first = false
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, cert)
+	}
+}
+
+// WriteCertToFile writes the certificate, its key and then the chain of
+// intermediates, if any
+func WriteCertToFile(path string, crt *pem.Block, key *pem.Block, chain ...*pem.Block) error {
 	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0660)
 	if err != nil {
 		return err
@@ -117,9 +211,19 @@ func WriteCertToFile(path string, crt *pem.Block, key *pem.Block) error {
 
 	if key != nil {
 		err = pem.Encode(fd, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, block := range chain {
+		err = pem.Encode(fd, block)
+		if err != nil {
+			return err
+		}
 	}
 
-	return err
+	return nil
 }
 
 func ReadCRL(path string) (*pkix.CertificateList, error) {
@@ -157,7 +261,8 @@ func CreateCRL(path string, crt *x509.Certificate, key *ecdsa.PrivateKey, number
 		return nil, err
 	}
 
-	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0660)
+	// renewing writes over the previous CRL, which may be longer
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0660)
 	if err != nil {
 		return nil, err
 	}
@@ -179,7 +284,7 @@ func CreateCRL(path string, crt *x509.Certificate, key *ecdsa.PrivateKey, number
 
 func GetCRLNumber(crl *pkix.CertificateList) (*big.Int, error) {
 	var oidExtensionCRLNumber = []int{2, 5, 29, 20}
-	var number big.Int
+	var number *big.Int
 
 	for _, ext := range crl.TBSCertList.Extensions {
 		if ext.Id.Equal(oidExtensionCRLNumber) {
@@ -188,7 +293,7 @@ func GetCRLNumber(crl *pkix.CertificateList) (*big.Int, error) {
 				return nil, err
 			}
 
-			return &number, nil
+			return number, nil
 		}
 	}
 
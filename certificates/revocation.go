@@ -0,0 +1,175 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const CRLWatchInterval = 5 * time.Second
+
+var ErrCertificateRevoked = errors.New("certificate has been revoked")
+var ErrStaleCRL = errors.New("CRL is older than the current one")
+var ErrExpiredCRL = errors.New("CRL is past its next update")
+
+// RevocationChecker holds the CRL currently enforced by a node and rejects
+// peer certificates listed in it during the TLS handshake
+type RevocationChecker struct {
+	ca *x509.Certificate
+
+	lock    sync.RWMutex
+	raw     []byte
+	number  *big.Int
+	revoked map[string]struct{}
+}
+
+func NewRevocationChecker(ca *x509.Certificate) *RevocationChecker {
+	return &RevocationChecker{
+		ca:      ca,
+		revoked: make(map[string]struct{}),
+	}
+}
+
+func (rc *RevocationChecker) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "could not read CRL at %s", path)
+	}
+
+	_, err = rc.Update(data)
+	return err
+}
+
+// Watch reloads the CRL at path whenever its modification time changes
+func (rc *RevocationChecker) Watch(path string, interval time.Duration) {
+	rc.watch(path, interval, nil)
+}
+
+// watch is Watch until stop is closed
+func (rc *RevocationChecker) watch(path string, interval time.Duration, stop <-chan struct{}) {
+	var lastModified time.Time
+
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	for {
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("could not stat CRL at %s: %s\n", path, err)
+			continue
+		}
+
+		if info.ModTime().Equal(lastModified) {
+			continue
+		}
+
+		// a failed load is retried on the next tick, the file may be half written
+		err = rc.LoadFile(path)
+		if err != nil {
+			log.Printf("could not reload CRL: %s\n", err)
+			continue
+		}
+
+		lastModified = info.ModTime()
+	}
+}
+
+// Update parses a PEM or DER encoded CRL and swaps it in if it is signed by
+// our CA, has not expired and is not older than the current one. It returns
+// whether the enforced CRL changed.
+func (rc *RevocationChecker) Update(data []byte) (bool, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return false, errors.Wrap(err, "could not parse CRL")
+	}
+
+	err = rc.ca.CheckCRLSignature(crl)
+	if err != nil {
+		return false, errors.Wrap(err, "CRL is not signed by our CA")
+	}
+
+	nextUpdate := crl.TBSCertList.NextUpdate
+	if !nextUpdate.IsZero() && time.Now().After(nextUpdate) {
+		log.Printf("rejecting CRL past its next update at %s, it must be signed again\n", nextUpdate)
+		return false, errors.Wrapf(ErrExpiredCRL, "next update was %s", nextUpdate)
+	}
+
+	number, err := GetCRLNumber(crl)
+	if err != nil {
+		number = big.NewInt(0)
+	}
+
+	revoked := make(map[string]struct{}, len(crl.TBSCertList.RevokedCertificates))
+	for _, entry := range crl.TBSCertList.RevokedCertificates {
+		revoked[entry.SerialNumber.String()] = struct{}{}
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	if rc.number != nil {
+		switch number.Cmp(rc.number) {
+		case -1:
+			return false, errors.Wrapf(ErrStaleCRL, "got number %s, have %s", number, rc.number)
+		case 0:
+			return false, nil
+		}
+	}
+
+	rc.raw = data
+	rc.number = number
+	rc.revoked = revoked
+
+	log.Printf("enforcing CRL number %s with %d revoked certificates\n", number, len(revoked))
+
+	return true, nil
+}
+
+// Raw returns the DER encoding of the current CRL, or nil if none was loaded
+func (rc *RevocationChecker) Raw() []byte {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+
+	return rc.raw
+}
+
+func (rc *RevocationChecker) IsRevoked(serial *big.Int) bool {
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+
+	_, revoked := rc.revoked[serial.String()]
+	return revoked
+}
+
+// VerifyPeerCertificate can be plugged into tls.Config. It runs after the
+// regular chain verification, so only verified chains are inspected.
+func (rc *RevocationChecker) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if rc.IsRevoked(cert.SerialNumber) {
+				log.Printf("rejecting revoked certificate serial %s subject %s\n", cert.SerialNumber, cert.Subject.CommonName)
+				return fmt.Errorf("%w: serial %s", ErrCertificateRevoked, cert.SerialNumber)
+			}
+		}
+	}
+
+	return nil
+}
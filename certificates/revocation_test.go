@@ -0,0 +1,279 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevocationCheckerRejectsExpiredCRL(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	ca, caKey := testCA(t, "ca")
+	rc := NewRevocationChecker(ca)
+
+	create := func(number int64, nextUpdate time.Time) []byte {
+		crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(number),
+			ThisUpdate: nextUpdate.Add(-time.Hour),
+			NextUpdate: nextUpdate,
+		}, ca, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crl
+	}
+
+	if _, err := rc.Update(create(1, time.Now().Add(-time.Minute))); !errors.Is(err, ErrExpiredCRL) {
+		t.Errorf("expired CRL accepted: %v", err)
+	}
+	if rc.Raw() != nil {
+		t.Error("expired CRL is enforced")
+	}
+
+	if changed, err := rc.Update(create(2, time.Now().Add(time.Hour))); err != nil || !changed {
+		t.Errorf("valid CRL not enforced: %v", err)
+	}
+}
+
+func TestCreateCRLReplacesFile(t *testing.T) {
+	ca, caKey := testCA(t, "ca")
+	path := filepath.Join(t.TempDir(), "crl.pem")
+
+	long := make([]pkix.RevokedCertificate, 50)
+	for i := range long {
+		long[i] = pkix.RevokedCertificate{SerialNumber: big.NewInt(int64(i + 1)), RevocationTime: time.Now()}
+	}
+
+	if _, err := CreateCRL(path, ca, caKey, big.NewInt(1), long); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCRL(path, ca, caKey, big.NewInt(2), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, rest := pem.Decode(data)
+	if block == nil || len(rest) != 0 {
+		t.Fatalf("%d bytes left after the CRL", len(rest))
+	}
+
+	rc := NewRevocationChecker(ca)
+	if err := rc.LoadFile(path); err != nil || rc.IsRevoked(big.NewInt(1)) {
+		t.Errorf("renewed CRL not loaded: %v", err)
+	}
+}
+
+func testCRL(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, number int64, serials ...int64) []byte {
+	t.Helper()
+
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(number),
+		RevokedCertificates: revoked,
+		ThisUpdate:          time.Now(),
+		NextUpdate:          time.Now().Add(time.Hour),
+	}, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+}
+
+func TestRevocationCheckerUpdate(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	ca, caKey := testCA(t, "ca")
+	other, otherKey := testCA(t, "other")
+	rc := NewRevocationChecker(ca)
+
+	if changed, err := rc.Update(testCRL(t, ca, caKey, 2, 10)); err != nil || !changed {
+		t.Fatalf("CRL not enforced: %v", err)
+	}
+
+	if changed, err := rc.Update(testCRL(t, ca, caKey, 2, 10)); err != nil || changed {
+		t.Errorf("same CRL number changed the CRL: %v", err)
+	}
+
+	if _, err := rc.Update(testCRL(t, ca, caKey, 1)); !errors.Is(err, ErrStaleCRL) {
+		t.Errorf("older CRL accepted: %v", err)
+	}
+
+	if _, err := rc.Update(testCRL(t, other, otherKey, 3)); err == nil {
+		t.Error("CRL from another CA accepted")
+	}
+
+	if _, err := rc.Update([]byte("garbage")); err == nil {
+		t.Error("invalid CRL accepted")
+	}
+
+	if !rc.IsRevoked(big.NewInt(10)) {
+		t.Error("rejected CRLs replaced the enforced one")
+	}
+
+	if changed, err := rc.Update(testCRL(t, ca, caKey, 3, 11)); err != nil || !changed || rc.IsRevoked(big.NewInt(10)) || !rc.IsRevoked(big.NewInt(11)) {
+		t.Errorf("newer CRL not swapped in: %v", err)
+	}
+
+	latest := testCRL(t, ca, caKey, 4)
+	rc.Update(latest)
+	if block, _ := pem.Decode(latest); string(rc.Raw()) != string(block.Bytes) {
+		t.Error("Raw does not return the enforced CRL")
+	}
+}
+
+func TestRevocationCheckerHandshake(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	ca, caKey := testCA(t, "ca")
+	rc := NewRevocationChecker(ca)
+
+	now := time.Now()
+	issue := func(role string, serial int64, subject string) tls.Certificate {
+		block, keyBlock, err := GenerateCert(role, ca, caKey, serial, subject, now, now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, _ := x509.ParseECPrivateKey(keyBlock.Bytes)
+		return tls.Certificate{Certificate: [][]byte{block.Bytes}, PrivateKey: key}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		MinVersion:            tls.VersionTLS13,
+		Certificates:          []tls.Certificate{issue(RoleServer, 2, "server")},
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		ClientCAs:             roots,
+		VerifyPeerCertificate: rc.VerifyPeerCertificate,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		RootCAs:      roots,
+		ServerName:   "server",
+		Certificates: []tls.Certificate{issue(RoleClient, 3, "client")},
+	}
+
+	// the server only checks the client certificate after the client is done
+	handshake := func() error {
+		result := make(chan error, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				result <- err
+				return
+			}
+			defer conn.Close()
+			result <- conn.(*tls.Conn).Handshake()
+		}()
+
+		conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+		if err == nil {
+			conn.Close()
+		}
+
+		return <-result
+	}
+
+	if err := handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rc.Update(testCRL(t, ca, caKey, 1, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handshake(); !errors.Is(err, ErrCertificateRevoked) {
+		t.Errorf("revoked certificate accepted: %v", err)
+	}
+}
+
+func TestRevocationCheckerWatch(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	ca, caKey := testCA(t, "ca")
+	rc := NewRevocationChecker(ca)
+	path := filepath.Join(t.TempDir(), "crl.pem")
+
+	modified := time.Now()
+	write := func(data []byte) {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		// changes are noticed by modification time
+		modified = modified.Add(time.Second)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(testCRL(t, ca, caKey, 1))
+	if err := rc.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go rc.watch(path, 10*time.Millisecond, stop)
+	time.Sleep(50 * time.Millisecond)
+
+	waitRevoked := func(serial int64) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !rc.IsRevoked(big.NewInt(serial)) {
+			if time.Now().After(deadline) {
+				t.Fatalf("serial %d not revoked", serial)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	write(testCRL(t, ca, caKey, 2, 10))
+	waitRevoked(10)
+
+	write([]byte("garbage"))
+	time.Sleep(50 * time.Millisecond)
+	write(testCRL(t, ca, caKey, 1))
+	time.Sleep(50 * time.Millisecond)
+
+	if !rc.IsRevoked(big.NewInt(10)) {
+		t.Error("invalid or stale CRL file replaced the enforced CRL")
+	}
+
+	write(testCRL(t, ca, caKey, 3, 11))
+	waitRevoked(11)
+}
@@ -0,0 +1,118 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Roles limit what a certificate can be used for: only servers accept
+// upstream connections, only upstreams send keepalives and so on
+const (
+	RoleCA       = "ca"
+	RoleServer   = "server"
+	RoleUpstream = "upstream"
+	RoleClient   = "client"
+	RoleAdmin    = "admin"
+	// intermediate CA the server issues enrolled upstreams with
+	RoleSigner = "signer"
+)
+
+var ValidRoles = []string{RoleCA, RoleServer, RoleUpstream, RoleClient, RoleAdmin, RoleSigner}
+
+// LeafRoles can be given to node certificates
+var LeafRoles = []string{RoleServer, RoleUpstream, RoleClient, RoleAdmin}
+
+var ErrInvalidRole = errors.New("invalid certificate role")
+var ErrRoleNotAllowed = errors.New("certificate role is not allowed")
+var ErrNoRole = errors.New("certificate has no role, it was issued before roles existed and must be reissued")
+
+// Roles are carried as organizational units of the certificate subject, set
+// by authority when the certificate is issued
+func Roles(cert *x509.Certificate) []string {
+	return cert.Subject.OrganizationalUnit
+}
+
+func HasRole(cert *x509.Certificate, role string) bool {
+	return slices.Contains(Roles(cert), role)
+}
+
+// RequireRole checks the certificate a node runs with, so one its peers would
+// reject stops it from starting instead
+func RequireRole(cert *x509.Certificate, role string) error {
+	if len(Roles(cert)) == 0 {
+		return errors.Wrapf(ErrNoRole, "certificate %s", cert.Subject.CommonName)
+	}
+
+	if !HasRole(cert, role) {
+		return errors.Wrapf(ErrRoleNotAllowed, "certificate %s has roles %v, expected %s", cert.Subject.CommonName, Roles(cert), role)
+	}
+
+	return nil
+}
+
+// extKeyUsage returns the TLS usages a certificate with role needs
+func extKeyUsage(role string) ([]x509.ExtKeyUsage, error) {
+	switch role {
+	case RoleCA:
+		return nil, nil
+	case RoleServer, RoleUpstream, RoleSigner:
+		// both accept TLS connections and open their own
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}, nil
+	case RoleClient, RoleAdmin:
+		return []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nil
+	}
+
+	return nil, errors.Wrapf(ErrInvalidRole, "%q", role)
+}
+
+// VerifyPeer can be plugged into tls.Config. It accepts peers carrying one
+// of roles whose certificate has not been revoked. Certificates issued by a
+// signer are only accepted as upstreams, whatever role they claim.
+func VerifyPeer(revocation *RevocationChecker, roles ...string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if revocation != nil {
+			err := revocation.VerifyPeerCertificate(rawCerts, verifiedChains)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, chain := range verifiedChains {
+			if issuedBySigner(chain) && !HasRole(chain[0], RoleUpstream) {
+				continue
+			}
+
+			for _, role := range roles {
+				if HasRole(chain[0], role) {
+					return nil
+				}
+			}
+		}
+
+		if len(verifiedChains) > 0 {
+			leaf := verifiedChains[0][0]
+			if len(Roles(leaf)) == 0 {
+				log.Printf("rejecting certificate %s, it has no role and must be reissued\n", leaf.Subject.CommonName)
+			} else {
+				log.Printf("rejecting certificate %s with roles %v, expected %v\n", leaf.Subject.CommonName, Roles(leaf), roles)
+			}
+		}
+
+		return fmt.Errorf("%w: expected %s", ErrRoleNotAllowed, strings.Join(roles, " or "))
+	}
+}
+
+func issuedBySigner(chain []*x509.Certificate) bool {
+	for _, cert := range chain[1:] {
+		if HasRole(cert, RoleSigner) {
+			return true
+		}
+	}
+
+	return false
+}
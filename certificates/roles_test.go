@@ -0,0 +1,144 @@
+package certificates
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestVerifyPeerRoles(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	now := time.Now()
+
+	caBlock, caKeyBlock, err := GenerateCert(RoleCA, nil, nil, 1, "ca", now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caBlock.Bytes)
+	caKey, _ := x509.ParseECPrivateKey(caKeyBlock.Bytes)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	issue := func(role string, usage x509.ExtKeyUsage) ([][]*x509.Certificate, error) {
+		block, _, err := GenerateCert(role, ca, caKey, 2, role+"-1", now, now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert, _ := x509.ParseCertificate(block.Bytes)
+		return cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}})
+	}
+
+	verify := VerifyPeer(nil, RoleUpstream, RoleAdmin)
+
+	for _, role := range []string{RoleUpstream, RoleAdmin} {
+		chains, err := issue(role, x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verify(nil, chains); err != nil {
+			t.Errorf("%s rejected: %s", role, err)
+		}
+	}
+
+	for _, role := range []string{RoleClient, RoleServer} {
+		chains, err := issue(role, x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := verify(nil, chains); !errors.Is(err, ErrRoleNotAllowed) {
+			t.Errorf("%s accepted: %v", role, err)
+		}
+	}
+
+	// client certificates cannot be used to pose as a server
+	if _, err := issue(RoleClient, x509.ExtKeyUsageServerAuth); err == nil {
+		t.Error("client certificate valid for server authentication")
+	}
+
+	if _, _, err := GenerateCert("root", ca, caKey, 3, "x", now, now.Add(time.Hour)); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("issued a certificate with an invalid role: %v", err)
+	}
+}
+
+func TestVerifyPeerSigner(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	now := time.Now()
+
+	ca, caKey := testCA(t, "ca")
+
+	signerBlock, signerKeyBlock, err := GenerateCert(RoleSigner, ca, caKey, 2, "signer", now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := x509.ParseCertificate(signerBlock.Bytes)
+	signerKey, _ := x509.ParseECPrivateKey(signerKeyBlock.Bytes)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(signer)
+
+	verify := VerifyPeer(nil, RoleUpstream, RoleAdmin)
+
+	for role, accepted := range map[string]bool{RoleUpstream: true, RoleAdmin: false} {
+		block, _, err := GenerateCert(role, signer, signerKey, 3, role+"-1", now, now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cert, _ := x509.ParseCertificate(block.Bytes)
+		chains, err := cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := verify(nil, chains); (err == nil) != accepted {
+			t.Errorf("%s issued by the signer: accepted %t, got %v", role, accepted, err)
+		}
+	}
+
+	// the signer cannot create other signers
+	block, keyBlock, err := GenerateCert(RoleSigner, signer, signerKey, 4, "signer-2", now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nested, _ := x509.ParseCertificate(block.Bytes)
+	nestedKey, _ := x509.ParseECPrivateKey(keyBlock.Bytes)
+	intermediates.AddCert(nested)
+
+	block, _, err = GenerateCert(RoleUpstream, nested, nestedKey, 5, "upstream-2", now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(block.Bytes)
+
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err == nil {
+		t.Error("certificate issued by a nested signer verified")
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	upstream := &x509.Certificate{Subject: pkix.Name{CommonName: "upstream-1", OrganizationalUnit: []string{RoleUpstream}}}
+	old := &x509.Certificate{Subject: pkix.Name{CommonName: "upstream-2"}}
+
+	if err := RequireRole(upstream, RoleUpstream); err != nil {
+		t.Error(err)
+	}
+	if err := RequireRole(upstream, RoleServer); !errors.Is(err, ErrRoleNotAllowed) {
+		t.Errorf("upstream certificate accepted as server: %v", err)
+	}
+	if err := RequireRole(old, RoleUpstream); !errors.Is(err, ErrNoRole) {
+		t.Errorf("certificate without a role accepted: %v", err)
+	}
+}
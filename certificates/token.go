@@ -0,0 +1,97 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidToken = errors.New("invalid enrollment token")
+var ErrTokenExpired = errors.New("enrollment token has expired")
+
+// EnrollmentToken lets a new upstream get a certificate for Subject once,
+// before Expires. Tokens are signed with the CA key, so only authority can
+// create them.
+type EnrollmentToken struct {
+	ID      string    `json:"id"`
+	Subject string    `json:"subject"`
+	Expires time.Time `json:"expires"`
+}
+
+func CreateEnrollmentToken(subject string, ttl time.Duration, caKey *ecdsa.PrivateKey) (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", errors.Wrap(err, "could not create token id")
+	}
+
+	payload, err := json.Marshal(EnrollmentToken{
+		ID:      hex.EncodeToString(id),
+		Subject: subject,
+		Expires: time.Now().Add(ttl).UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(encoded))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, caKey, digest[:])
+	if err != nil {
+		return "", errors.Wrap(err, "could not sign token")
+	}
+
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// ParseEnrollmentToken checks token was signed by ca and has not expired.
+// Whether it was already used is up to the caller.
+func ParseEnrollmentToken(token string, ca *x509.Certificate) (*EnrollmentToken, error) {
+	encoded, encodedSignature, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	caKey, ok := ca.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: CA key is not ECDSA", ErrInvalidToken)
+	}
+
+	digest := sha256.Sum256([]byte(encoded))
+	if !ecdsa.VerifyASN1(caKey, digest[:], signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var parsed EnrollmentToken
+
+	err = json.Unmarshal(payload, &parsed)
+	if err != nil || parsed.ID == "" || parsed.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	if time.Now().After(parsed.Expires) {
+		return nil, fmt.Errorf("%w: expired at %s", ErrTokenExpired, parsed.Expires)
+	}
+
+	return &parsed, nil
+}
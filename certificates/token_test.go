@@ -0,0 +1,63 @@
+package certificates
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnrollmentToken(t *testing.T) {
+	now := time.Now()
+
+	ca, caKey := testCA(t, "ca")
+	other, otherKey := testCA(t, "other")
+
+	token, err := CreateEnrollmentToken("upstream-1", time.Hour, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseEnrollmentToken(token, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Subject != "upstream-1" || parsed.ID == "" || parsed.Expires.Before(now) {
+		t.Errorf("unexpected token %+v", parsed)
+	}
+
+	if _, err := ParseEnrollmentToken(token, other); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token accepted by another CA: %v", err)
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+	forged, _ := CreateEnrollmentToken("upstream-2", time.Hour, otherKey)
+	_, forgedSignature, _ := strings.Cut(forged, ".")
+
+	for _, invalid := range []string{"", "garbage", payload, payload + "." + forgedSignature, "x" + payload + "." + signature} {
+		if _, err := ParseEnrollmentToken(invalid, ca); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("invalid token %q accepted: %v", invalid, err)
+		}
+	}
+
+	expired, _ := CreateEnrollmentToken("upstream-1", -time.Second, caKey)
+	if _, err := ParseEnrollmentToken(expired, ca); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("expired token accepted: %v", err)
+	}
+}
+
+func testCA(t *testing.T, subject string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	now := time.Now()
+
+	block, keyBlock, err := GenerateCert(RoleCA, nil, nil, 1, subject, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(block.Bytes)
+	key, _ := x509.ParseECPrivateKey(keyBlock.Bytes)
+
+	return cert, key
+}
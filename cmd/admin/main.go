@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/config"
+	"github.com/ca0s/despiste/tracker"
+)
+
+const (
+	ModeList    = "list"
+	ModeGet     = "get"
+	ModeAdd     = "add"
+	ModeRemove  = "remove"
+	ModeEnable  = "enable"
+	ModeDisable = "disable"
+	ModeDrain   = "drain"
+)
+
+func main() {
+	var (
+		action string
+
+		trackerURL string
+		serverID   string
+		certFile   string
+		caFile     string
+		crlFile    string
+
+		key              string
+		tags             string
+		weight           int
+		maxConnections   int64
+		useSourceAddress bool
+
+		ValidModes = []string{ModeList, ModeGet, ModeAdd, ModeRemove, ModeEnable, ModeDisable, ModeDrain}
+	)
+
+	flag.StringVar(&action, "action", "", "Action to perform. Options are list, get, add, remove, enable, disable and drain")
+
+	flag.StringVar(&trackerURL, "tracker-url", "https://127.0.0.1:8000", "Tracker API URL")
+	flag.StringVar(&serverID, "server-id", "server", "Server name, as defined by its TLS certificate")
+	flag.StringVar(&certFile, "cert", "data/certs/admin.pem", "Admin certificate crt+key PEM file location")
+	flag.StringVar(&caFile, "ca", "data/certs/ca.pem", "CA crt PEM file location")
+	flag.StringVar(&crlFile, "crl", "", "CRL PEM file location, revoked server certificates are rejected")
+
+	flag.StringVar(&key, "key", "", "Upstream key, the subject of its certificate")
+	flag.StringVar(&tags, "tags", "", "Comma separated tags for the new upstream")
+	flag.IntVar(&weight, "weight", 0, "Weight of the new upstream")
+	flag.Int64Var(&maxConnections, "max-connections", 0, "Most concurrent connections through the new upstream, 0 for no limit")
+	flag.BoolVar(&useSourceAddress, "use-source-address", false, "Dial the new upstream at the source IP of its keepalives")
+
+	flag.Parse()
+
+	validMode := false
+	for _, m := range ValidModes {
+		if action == m {
+			validMode = true
+			break
+		}
+	}
+
+	if !validMode {
+		flag.Usage()
+		return
+	}
+
+	if key == "" && action != ModeList {
+		log.Printf("key cannot be empty\n")
+		return
+	}
+
+	caCert, _, err := certificates.ReadCert(caFile, false)
+	if err != nil {
+		log.Printf("could not read CA certificate: %s\n", err)
+		return
+	}
+
+	revocation := certificates.NewRevocationChecker(caCert)
+	if crlFile != "" {
+		err = revocation.LoadFile(crlFile)
+		if err != nil {
+			log.Printf("could not load CRL: %s\n", err)
+			return
+		}
+	}
+
+	adminCert, adminKey, err := certificates.ReadCert(certFile, true)
+	if err != nil {
+		log.Printf("could not read admin certificate: %s\n", err)
+		return
+	}
+
+	client := tracker.NewAdminClient(trackerURL, serverID, caCert, adminCert, adminKey, revocation)
+
+	var result any
+
+	switch action {
+	case ModeList:
+		result, err = client.Upstreams()
+
+	case ModeGet:
+		result, err = client.GetUpstreamState(key)
+
+	case ModeAdd:
+		upstreamConfig := config.UpstreamConfig{
+			Key:              key,
+			Weight:           weight,
+			MaxConnections:   maxConnections,
+			UseSourceAddress: useSourceAddress,
+		}
+
+		if tags != "" {
+			upstreamConfig.Tags = strings.Split(tags, ",")
+		}
+
+		result, err = client.AddUpstream(upstreamConfig)
+
+	case ModeRemove:
+		err = client.RemoveUpstream(key)
+		if err == nil {
+			log.Printf("upstream %s removed\n", key)
+		}
+
+	case ModeEnable:
+		result, err = client.SetUpstreamState(key, tracker.UpstreamStateEnabled)
+
+	case ModeDisable:
+		result, err = client.SetUpstreamState(key, tracker.UpstreamStateDisabled)
+
+	case ModeDrain:
+		result, err = client.SetUpstreamState(key, tracker.UpstreamStateDraining)
+	}
+
+	if err != nil {
+		log.Printf("%s failed: %s\n", action, err)
+		os.Exit(1)
+	}
+
+	if result != nil {
+		printJSON(result)
+	}
+}
+
+func printJSON(v any) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("could not encode result: %s\n", err)
+		return
+	}
+
+	var indented bytes.Buffer
+	json.Indent(&indented, encoded, "", "  ")
+	fmt.Println(indented.String())
+}
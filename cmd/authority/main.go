@@ -1,13 +1,12 @@
 package main
 
 import (
-	"crypto/rand"
 	"crypto/x509/pkix"
 	"flag"
 	"fmt"
 	"log"
-	"math"
 	"math/big"
+	"slices"
 	"time"
 
 	"github.com/ca0s/despiste/certificates"
@@ -17,6 +16,9 @@ const (
 	ModeInitCA = "init-ca"
 	ModeCert   = "cert"
 	ModeRevoke = "revoke"
+	ModeSigner = "init-signer"
+	ModeToken  = "token"
+	ModeCRL    = "renew-crl"
 )
 
 func main() {
@@ -29,18 +31,21 @@ func main() {
 
 		serialNumber int64
 		subject      string
+		role         string
 		notBefore    string
 		notAfter     string
 
 		crlFile string
 
+		tokenTTL time.Duration
+
 		tNotBefore time.Time
 		tNotAfter  time.Time
 
-		ValidModes = []string{ModeInitCA, ModeCert, ModeRevoke}
+		ValidModes = []string{ModeInitCA, ModeCert, ModeRevoke, ModeSigner, ModeToken, ModeCRL}
 	)
 
-	flag.StringVar(&action, "action", "", "Action to perform. Options are init-ca and cert")
+	flag.StringVar(&action, "action", "", "Action to perform. Options are init-ca, cert, revoke, renew-crl, init-signer and token")
 
 	flag.StringVar(&caFile, "ca", "data/certs/cafull.pem", "File to write the CA PEM cert+key to")
 	flag.StringVar(&caPublicFile, "capub", "data/certs/ca.pem", "File to write the CA PEM public cert to")
@@ -51,9 +56,12 @@ func main() {
 
 	flag.Int64Var(&serialNumber, "serial", 0, "Serial number for the new certificate. A random value is chosen if no value given")
 	flag.StringVar(&subject, "subject", "", "Subject for the new certificate. Must match whatever name you will assign to your upstreams")
+	flag.StringVar(&role, "role", "", "Role of the new certificate: server, upstream, client or admin")
 	flag.StringVar(&notBefore, "not-before", "", "Certificate validity start")
 	flag.StringVar(&notAfter, "not-after", "", "Certificate validity end")
 
+	flag.DurationVar(&tokenTTL, "ttl", 24*time.Hour, "How long a new enrollment token can be used for")
+
 	flag.Parse()
 
 	validMode := false
@@ -97,19 +105,28 @@ func main() {
 		tNotAfter = time.Now().Add(2 * 365 * 24 * time.Hour)
 	}
 
-	if subject == "" && action != ModeRevoke {
+	if subject == "" && action != ModeRevoke && action != ModeCRL {
 		log.Printf("subject cannot be empty\n")
 		return
 	}
 
 	if serialNumber == 0 {
-		bn, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+		var err error
+
+		serialNumber, err = certificates.RandomSerial()
 		if err != nil {
-			log.Printf("could not create random serial: %s\n", err)
+			log.Printf("%s\n", err)
 			return
 		}
+	}
 
-		serialNumber = bn.Int64()
+	if action == ModeCert && !slices.Contains(certificates.LeafRoles, role) {
+		log.Printf("role must be one of server, upstream, client or admin\n")
+		return
+	}
+
+	if certFile == "" && action == ModeSigner {
+		certFile = "data/certs/signer.pem"
 	}
 
 	if certFile == "" {
@@ -119,7 +136,7 @@ func main() {
 	switch action {
 	case "init-ca":
 		newCA, newCAkey, err := certificates.GenerateCert(
-			true, nil, nil,
+			certificates.RoleCA, nil, nil,
 			serialNumber, subject,
 			tNotBefore, tNotAfter,
 		)
@@ -148,7 +165,7 @@ func main() {
 		}
 
 		newCert, newKey, err := certificates.GenerateCert(
-			false, caCert, caKey,
+			role, caCert, caKey,
 			serialNumber, subject,
 			tNotBefore, tNotAfter,
 		)
@@ -163,6 +180,78 @@ func main() {
 			return
 		}
 
+	case ModeSigner:
+		caCert, caKey, err := certificates.ReadCert(caFile, true)
+		if err != nil {
+			log.Printf("could not read CA certificate: %s\n", err.Error())
+			return
+		}
+
+		signerCert, signerKey, err := certificates.GenerateCert(
+			certificates.RoleSigner, caCert, caKey,
+			serialNumber, subject,
+			tNotBefore, tNotAfter,
+		)
+		if err != nil {
+			log.Printf("error creating signer certificate: %s\n", err.Error())
+			return
+		}
+
+		err = certificates.WriteCertToFile(certFile, signerCert, signerKey)
+		if err != nil {
+			log.Printf("error writing signer certificate to %s: %s\n", certFile, err)
+			return
+		}
+
+	case ModeToken:
+		_, caKey, err := certificates.ReadCert(caFile, true)
+		if err != nil {
+			log.Printf("could not read CA certificate: %s\n", err.Error())
+			return
+		}
+
+		token, err := certificates.CreateEnrollmentToken(subject, tokenTTL, caKey)
+		if err != nil {
+			log.Printf("could not create enrollment token: %s\n", err)
+			return
+		}
+
+		fmt.Println(token)
+
+	case ModeCRL:
+		caCert, caKey, err := certificates.ReadCert(caFile, true)
+		if err != nil {
+			log.Printf("could not read CA certificate: %s\n", err.Error())
+			return
+		}
+
+		currentCRL, err := certificates.ReadCRL(crlFile)
+		if err != nil {
+			log.Printf("could not read CRL at %s: %s\n", crlFile, err)
+			return
+		}
+
+		currentCRLNumber, err := certificates.GetCRLNumber(currentCRL)
+		if err != nil {
+			log.Printf("could not get current CRL number: %s\n", err)
+			currentCRLNumber = big.NewInt(0)
+		}
+
+		// same revoked certificates, with a new number and validity
+		_, err = certificates.CreateCRL(
+			crlFile,
+			caCert,
+			caKey,
+			currentCRLNumber.Add(currentCRLNumber, big.NewInt(1)),
+			currentCRL.TBSCertList.RevokedCertificates,
+		)
+		if err != nil {
+			log.Printf("could not create CRL: %s\n", err)
+			return
+		}
+
+		log.Printf("CRL renewed\n")
+
 	case "revoke":
 		caCert, caKey, err := certificates.ReadCert(caFile, true)
 		if err != nil {
@@ -18,6 +18,9 @@ func main() {
 
 		certFile string
 		caFile   string
+		crlFile  string
+
+		forwardUsername bool
 	)
 
 	flag.StringVar(&serverAddress, "server-address", "", "despiste server address:port")
@@ -25,6 +28,8 @@ func main() {
 	flag.StringVar(&serverID, "server-id", "server", "Server name, as defined by its TLS certificate")
 	flag.StringVar(&certFile, "cert", "data/certs/client.pem", "Certificate crt+key PEM file location")
 	flag.StringVar(&caFile, "ca", "data/certs/ca.pem", "CA crt PEM file location")
+	flag.StringVar(&crlFile, "crl", "", "CRL PEM file location, revoked server certificates are rejected")
+	flag.BoolVar(&forwardUsername, "forward-username", false, "Require socks5 username auth locally and forward the username to the server, to choose the exit node")
 
 	flag.Parse()
 
@@ -39,15 +44,30 @@ func main() {
 		return
 	}
 
+	revocation := certificates.NewRevocationChecker(caCert)
+	if crlFile != "" {
+		err = revocation.LoadFile(crlFile)
+		if err != nil {
+			log.Printf("could not load CRL: %s\n", err)
+			return
+		}
+	}
+
 	clientCert, clientKey, err := certificates.ReadCert(certFile, true)
 	if err != nil {
 		log.Printf("could not read client certificate: %s\n", err)
 		return
 	}
 
+	err = certificates.RequireRole(clientCert, certificates.RoleClient)
+	if err != nil {
+		log.Printf("%s\n", err)
+		return
+	}
+
 	staticUpstreamProvider := NewStaticUpstreamProvider(serverAddress, serverID)
 
-	upstreamDialer, err := network.NewUpstreamDialer(staticUpstreamProvider, caCert, clientCert, clientKey)
+	upstreamDialer, err := network.NewUpstreamDialer(staticUpstreamProvider, caCert, clientCert, clientKey, revocation, certificates.RoleServer, network.UpstreamDialerOptions{})
 	if err != nil {
 		log.Printf("could not create upstream dialer: %s\n", err.Error())
 		return
@@ -62,6 +82,13 @@ func main() {
 		Dial: upstreamDialer.Dial,
 	}
 
+	if forwardUsername {
+		conf.AuthMethods = []socks5.Authenticator{
+			socks5.UserPassAuthenticator{Credentials: network.UsernameCredentials{}},
+		}
+		conf.Rules = &network.ForwardUsernameRules{RuleSet: conf.Rules}
+	}
+
 	server, err := socks5.New(&conf)
 	if err != nil {
 		panic(err)
@@ -1,6 +1,10 @@
 package main
 
-import "github.com/ca0s/despiste/tracker"
+import (
+	"context"
+
+	"github.com/ca0s/despiste/tracker"
+)
 
 type StaticUpstreamProvider struct {
 	addr     string
@@ -9,16 +13,12 @@ type StaticUpstreamProvider struct {
 
 func NewStaticUpstreamProvider(addr string, name string) *StaticUpstreamProvider {
 	return &StaticUpstreamProvider{
-		addr: addr,
-		upstream: &tracker.Upstream{
-			Address:   addr,
-			Key:       name,
-			Enabled:   true,
-			Available: true,
-		},
+		addr:     addr,
+		upstream: tracker.NewUpstream(name, addr),
 	}
 }
 
-func (p *StaticUpstreamProvider) GetUpstream() (*tracker.Upstream, error) {
+func (p *StaticUpstreamProvider) GetUpstream(ctx context.Context, request *tracker.SelectionRequest) (*tracker.Upstream, error) {
+	p.upstream.ConnectionOpened()
 	return p.upstream, nil
 }
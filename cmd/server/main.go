@@ -3,8 +3,12 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/armon/go-socks5"
+	"github.com/ca0s/despiste/certificates"
 	"github.com/ca0s/despiste/config"
 	"github.com/ca0s/despiste/network"
 	"github.com/ca0s/despiste/tracker"
@@ -21,17 +25,91 @@ func main() {
 		return
 	}
 
+	if cfg.CRLFile != "" {
+		go cfg.Revocation.Watch(cfg.CRLFile, certificates.CRLWatchInterval)
+	}
+
+	selector, err := tracker.NewSelector(cfg.Selector)
+	if err != nil {
+		log.Printf("error creating upstream selector: %s\n", err)
+		return
+	}
+
+	affinity, err := tracker.NewAffinity(cfg.Affinity, cfg.AffinityTTL)
+	if err != nil {
+		log.Printf("error creating upstream affinity: %s\n", err)
+		return
+	}
+
+	// upstreams send keepalives, admins use the admin API and servers may
+	// list the upstreams
+	trackerTLSConfig := network.NewTLSServerConfig(cfg.CACert, cfg.Cert, cfg.Key, cfg.Chain, cfg.Revocation, certificates.RoleUpstream, certificates.RoleAdmin, certificates.RoleServer)
+	trackerServer := tracker.NewTrackerServer(cfg, selector, affinity, trackerTLSConfig)
+
+	if cfg.UpstreamKeysFile != "" {
+		go trackerServer.WatchUpstreamKeys(tracker.UpstreamKeysWatchInterval)
+	}
+
+	if cfg.StateFile != "" {
+		go trackerServer.PersistState(cfg.StateFile, cfg.StateInterval)
+		go saveStateOnExit(trackerServer, cfg.StateFile)
+	}
+
 	log.Printf("starting tracker API server at %s\n", cfg.TrackerAddress)
-	trackerServer := tracker.NewTrackerServer(cfg.TrackerAddress, cfg.UpstreamKeys, cfg.UpstreamDeadline, cfg.CertFile)
 	go trackerServer.Run()
 
-	upstreamSelector, err := network.NewUpstreamDialer(trackerServer, cfg.CACert, cfg.Cert, cfg.Key)
+	if cfg.EnrollmentSigner != "" {
+		log.Printf("starting enrollment server at %s\n", cfg.EnrollmentAddress)
+		go func() {
+			err := trackerServer.RunEnrollment()
+			log.Printf("enrollment server finished: %s\n", err)
+		}()
+	}
+
+	upstreamSelector, err := network.NewUpstreamDialer(
+		trackerServer,
+		cfg.CACert, cfg.Cert, cfg.Key,
+		cfg.Revocation,
+		certificates.RoleUpstream,
+		network.UpstreamDialerOptions{
+			Retries: cfg.DialRetries,
+			Timeout: cfg.DialTimeout,
+		},
+	)
 	if err != nil {
 		log.Printf("could not create upstream dialer: %s\n", err.Error())
 		return
 	}
 
+	if cfg.ProbeInterval > 0 {
+		prober, err := network.NewUpstreamProber(
+			trackerServer,
+			cfg.CACert, cfg.Cert, cfg.Key,
+			cfg.Revocation,
+			network.UpstreamProberOptions{
+				Interval:    cfg.ProbeInterval,
+				Timeout:     cfg.ProbeTimeout,
+				Destination: cfg.ProbeDestination,
+			},
+		)
+		if err != nil {
+			log.Printf("could not create upstream prober: %s\n", err.Error())
+			return
+		}
+
+		go prober.Run()
+	}
+
+	if len(cfg.Webhooks) > 0 {
+		tracker.NewWebhookNotifier(cfg).Start(trackerServer)
+	}
+
 	conf := socks5.Config{
+		// clients may choose their exit through the socks5 username
+		AuthMethods: []socks5.Authenticator{
+			socks5.NoAuthAuthenticator{},
+			socks5.UserPassAuthenticator{Credentials: network.UsernameCredentials{}},
+		},
 		Rules: &socks5.PermitCommand{
 			EnableConnect:   true,
 			EnableBind:      false,
@@ -40,12 +118,9 @@ func main() {
 		Dial: upstreamSelector.Dial,
 	}
 
-	server, err := socks5.New(&conf)
-	if err != nil {
-		panic(err)
-	}
+	server := network.NewSocksServer(conf)
 
-	tlsListener, err := network.NewTLSListener(cfg.NodeAddress, cfg.CACert, cfg.Cert, cfg.Key)
+	tlsListener, err := network.NewTLSListener(cfg.NodeAddress, cfg.CACert, cfg.Cert, cfg.Key, cfg.Chain, cfg.Revocation, certificates.RoleClient)
 	if err != nil {
 		log.Printf("could not start tls listener at %s: %s\n", cfg.NodeAddress, err.Error())
 		return
@@ -57,3 +132,20 @@ func main() {
 		panic(err)
 	}
 }
+
+// saveStateOnExit saves the tracker state one last time when the server is
+// asked to stop, so a restart does not lose the latest changes
+func saveStateOnExit(trackerServer *tracker.TrackerServer, path string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	<-signals
+
+	err := trackerServer.SaveState(path)
+	if err != nil {
+		log.Printf("could not save tracker state: %s\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
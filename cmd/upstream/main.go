@@ -1,31 +1,77 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/armon/go-socks5"
+	"github.com/ca0s/despiste/certificates"
 	"github.com/ca0s/despiste/config"
 	"github.com/ca0s/despiste/network"
 	"github.com/ca0s/despiste/tracker"
 )
 
 func main() {
-	var configPath string
+	var (
+		configPath string
+
+		enrollToken    string
+		enrollURL      string
+		enrollServerID string
+		caFile         string
+		certFile       string
+	)
+
 	flag.StringVar(&configPath, "config", "/etc/despiste/upstream.json", "despiste config path")
+
+	flag.StringVar(&enrollToken, "enroll", "", "Get a certificate with this enrollment token and exit")
+	flag.StringVar(&enrollURL, "enroll-url", "", "URL of the server enrollment endpoint")
+	flag.StringVar(&enrollServerID, "server-id", "", "Subject of the server certificate")
+	flag.StringVar(&caFile, "ca", "/etc/despiste/ca.pem", "CA certificate, when enrolling")
+	flag.StringVar(&certFile, "cert", "/etc/despiste/cert.pem", "File to write the new certificate+key to, when enrolling")
+
 	flag.Parse()
 
+	if enrollToken != "" {
+		err := enroll(enrollToken, enrollURL, enrollServerID, caFile, certFile)
+		if err != nil {
+			log.Printf("could not enroll: %s\n", err)
+			os.Exit(1)
+		}
+
+		log.Printf("certificate written to %s\n", certFile)
+		return
+	}
+
 	cfg, err := config.ReadConfig(configPath, false)
 	if err != nil {
 		log.Printf("error reading config: %s\n", err.Error())
 		return
 	}
 
+	if cfg.CRLFile != "" {
+		go cfg.Revocation.Watch(cfg.CRLFile, certificates.CRLWatchInterval)
+	}
+
+	// only the server relays connections through upstreams
+	tlsListener, err := network.NewTLSListener(cfg.NodeAddress, cfg.CACert, cfg.Cert, cfg.Key, cfg.Chain, cfg.Revocation, certificates.RoleServer)
+	if err != nil {
+		log.Printf("could not create tls listener: %s\n", err)
+		return
+	}
+
+	loadListener := network.NewLoadListener(tlsListener, cfg.Capacity)
+
 	trackerClient := tracker.NewTrackerClient(
 		cfg.NodeID,
-		cfg.TrackerURL, cfg.NodeAddress, cfg.KeepAlive,
+		cfg.TrackerURL, cfg.NodeAddress, cfg.Tags, loadListener, cfg.KeepAlive,
 		cfg.TrackerID,
 		cfg.CACert,
+		cfg.Cert, cfg.Key, cfg.Chain,
+		cfg.Revocation,
 	)
 	go trackerClient.Run()
 
@@ -38,18 +84,35 @@ func main() {
 		},
 	}
 
-	tlsListener, err := network.NewTLSListener(cfg.NodeAddress, cfg.CACert, cfg.Cert, cfg.Key)
-	if err != nil {
-		log.Printf("could not create tls listener: %s\n", err)
-		return
-	}
-
 	server, err := socks5.New(&conf)
 	if err != nil {
 		log.Printf("could not create socks server: %s\n", err.Error())
 		return
 	}
 
-	err = server.Serve(tlsListener)
+	err = server.Serve(loadListener)
 	log.Printf("server finished: %s\n", err.Error())
 }
+
+func enroll(token string, url string, serverID string, caFile string, certFile string) error {
+	if url == "" || serverID == "" {
+		return errors.New("enroll-url and server-id are required")
+	}
+
+	// never overwrite an existing identity
+	if _, err := os.Stat(certFile); err == nil {
+		return fmt.Errorf("%s already exists", certFile)
+	}
+
+	caCert, _, err := certificates.ReadCert(caFile, false)
+	if err != nil {
+		return err
+	}
+
+	cert, key, chain, err := tracker.EnrollUpstream(url, serverID, caCert, token)
+	if err != nil {
+		return err
+	}
+
+	return certificates.WriteCertToFile(certFile, cert, key, chain...)
+}
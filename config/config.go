@@ -5,7 +5,9 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"net"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/ca0s/despiste/certificates"
@@ -15,23 +17,82 @@ type Config struct {
 	// common fields
 	CAFile   string `json:"ca"`
 	CertFile string `json:"cert"`
+	CRLFile  string `json:"crl"`
 
-	CACert *x509.Certificate `json:"-"`
-	Cert   *x509.Certificate `json:"-"`
-	Key    *ecdsa.PrivateKey `json:"-"`
+	CACert     *x509.Certificate               `json:"-"`
+	Cert       *x509.Certificate               `json:"-"`
+	Key        *ecdsa.PrivateKey               `json:"-"`
+	Chain      []*x509.Certificate             `json:"-"`
+	Revocation *certificates.RevocationChecker `json:"-"`
 
 	NodeID      string `json:"-"`
 	NodeAddress string `json:"node_address"`
 
 	// server fields
-	TrackerAddress   string        `json:"tracker_address"`
-	UpstreamKeys     []string      `json:"upstreams"`
-	UpstreamDeadline time.Duration `json:"upstream_deadline"`
+	TrackerAddress   string           `json:"tracker_address"`
+	Upstreams        []UpstreamConfig `json:"upstreams"`
+	UpstreamDeadline time.Duration    `json:"upstream_deadline"`
+	Selector         string           `json:"selector"`
+	Affinity         string           `json:"affinity"`
+	AffinityTTL      time.Duration    `json:"affinity_ttl"`
+
+	ClientPolicies map[string]ClientPolicy `json:"client_policies"`
+	// certificate subjects allowed to use the tracker admin API
+	Admins []string `json:"admins"`
+
+	DialRetries int           `json:"dial_retries"`
+	DialTimeout time.Duration `json:"dial_timeout"`
+	// how long a connection waits for a slot when all upstreams are full
+	QueueTimeout time.Duration `json:"queue_timeout"`
+
+	BreakerThreshold  int           `json:"breaker_threshold"`
+	BreakerBackoff    time.Duration `json:"breaker_backoff"`
+	BreakerMaxBackoff time.Duration `json:"breaker_max_backoff"`
+
+	// how often the server health checks each upstream, 0 disables it
+	ProbeInterval time.Duration `json:"probe_interval"`
+	ProbeTimeout  time.Duration `json:"probe_timeout"`
+	// optional destination the probes CONNECT to through the upstream
+	ProbeDestination string `json:"probe_destination"`
+
+	Webhooks       []WebhookConfig `json:"webhooks"`
+	WebhookRetries int             `json:"webhook_retries"`
+	WebhookBackoff time.Duration   `json:"webhook_backoff"`
+	// an upstream changing state this many times within the window is flapping
+	FlapThreshold int           `json:"flap_threshold"`
+	FlapWindow    time.Duration `json:"flap_window"`
+	// warn about certificates expiring within this time
+	CertExpiryWarning time.Duration `json:"cert_expiry_warning"`
+
+	// upstreams added at runtime, on top of the ones in upstreams
+	UpstreamKeysFile string `json:"upstream_keys_file"`
+
+	// register any upstream with a certificate carrying the upstream role,
+	// optionally only if its subject matches the pattern
+	AutoAdmitUpstreams bool   `json:"auto_admit_upstreams"`
+	AutoAdmitPattern   string `json:"auto_admit_pattern"`
+
+	// registry snapshot restored on boot, empty to disable
+	StateFile     string        `json:"state_file"`
+	StateInterval time.Duration `json:"state_interval"`
+
+	// signer certificate+key issuing certificates to upstreams enrolling
+	// with a token from authority, empty to disable enrollment
+	EnrollmentSigner   string        `json:"enrollment_signer"`
+	EnrollmentAddress  string        `json:"enrollment_address"`
+	EnrollmentLedger   string        `json:"enrollment_ledger"`
+	EnrollmentValidity time.Duration `json:"enrollment_validity"`
+
+	SignerCert *x509.Certificate `json:"-"`
+	SignerKey  *ecdsa.PrivateKey `json:"-"`
 
 	// upstream fields
 	KeepAlive  time.Duration `json:"keepalive"`
 	TrackerID  string        `json:"tracker_id"`
 	TrackerURL string        `json:"tracker_url"`
+	Tags       []string      `json:"tags"`
+	// connections the upstream tells the tracker it can handle, 0 for no limit
+	Capacity int64 `json:"capacity"`
 }
 
 func ReadConfig(path string, isServer bool) (*Config, error) {
@@ -44,7 +105,23 @@ func ReadConfig(path string, isServer bool) (*Config, error) {
 		CAFile:           "/etc/despiste/ca.pem",
 		CertFile:         "/etc/despiste/cert.pem",
 		UpstreamDeadline: time.Minute,
-		KeepAlive:        30 * time.Second,
+		AffinityTTL:      30 * time.Minute,
+		DialRetries:      2,
+		DialTimeout:      30 * time.Second,
+		QueueTimeout:     10 * time.Second,
+
+		BreakerThreshold:   5,
+		BreakerBackoff:     10 * time.Second,
+		BreakerMaxBackoff:  5 * time.Minute,
+		ProbeTimeout:       5 * time.Second,
+		WebhookRetries:     5,
+		WebhookBackoff:     time.Second,
+		FlapThreshold:      4,
+		FlapWindow:         10 * time.Minute,
+		CertExpiryWarning:  14 * 24 * time.Hour,
+		StateInterval:      10 * time.Second,
+		EnrollmentValidity: 365 * 24 * time.Hour,
+		KeepAlive:          30 * time.Second,
 	}
 
 	err = json.NewDecoder(fd).Decode(&cfg)
@@ -60,6 +137,58 @@ func ReadConfig(path string, isServer bool) (*Config, error) {
 		if cfg.TrackerAddress == "" {
 			return nil, errors.New("tracker_address cannot be empty")
 		}
+
+		for _, upstream := range cfg.Upstreams {
+			if err := upstream.Validate(); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, webhook := range cfg.Webhooks {
+			if webhook.URL == "" {
+				return nil, errors.New("webhook url cannot be empty")
+			}
+		}
+
+		// connections wait for an upstream up to it, there is no other bound
+		if cfg.DialTimeout <= 0 {
+			return nil, errors.New("dial_timeout must be positive")
+		}
+
+		if _, err := filepath.Match(cfg.AutoAdmitPattern, ""); err != nil {
+			return nil, errors.New("auto_admit_pattern is not a valid pattern")
+		}
+
+		if cfg.StateFile != "" && cfg.StateInterval <= 0 {
+			return nil, errors.New("state_interval must be positive")
+		}
+
+		if cfg.EnrollmentSigner != "" {
+			if cfg.EnrollmentAddress == "" {
+				return nil, errors.New("enrollment_address cannot be empty")
+			}
+
+			// used tokens must be remembered across restarts
+			if cfg.EnrollmentLedger == "" {
+				return nil, errors.New("enrollment_ledger cannot be empty")
+			}
+
+			// enrolled upstreams are only kept across restarts in the keys file,
+			// or admitted again on their first keep-alive
+			if cfg.UpstreamKeysFile == "" && !cfg.AutoAdmitUpstreams {
+				return nil, errors.New("enrollment needs upstream_keys_file or auto_admit_upstreams")
+			}
+
+			if cfg.EnrollmentValidity <= 0 {
+				return nil, errors.New("enrollment_validity must be positive")
+			}
+		}
+
+		if cfg.ProbeDestination != "" {
+			if _, _, err := net.SplitHostPort(cfg.ProbeDestination); err != nil {
+				return nil, errors.New("probe_destination must be a host:port address")
+			}
+		}
 	}
 
 	if !isServer {
@@ -79,6 +208,14 @@ func ReadConfig(path string, isServer bool) (*Config, error) {
 
 	cfg.CACert = caCert
 
+	cfg.Revocation = certificates.NewRevocationChecker(caCert)
+	if cfg.CRLFile != "" {
+		err = cfg.Revocation.LoadFile(cfg.CRLFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	cert, key, err := certificates.ReadCert(cfg.CertFile, true)
 	if err != nil {
 		return nil, err
@@ -86,7 +223,39 @@ func ReadConfig(path string, isServer bool) (*Config, error) {
 	cfg.Cert = cert
 	cfg.Key = key
 
+	role := certificates.RoleUpstream
+	if isServer {
+		role = certificates.RoleServer
+	}
+
+	if err := certificates.RequireRole(cert, role); err != nil {
+		return nil, err
+	}
+
+	cfg.Chain, err = certificates.ReadChain(cfg.CertFile)
+	if err != nil {
+		return nil, err
+	}
+
 	cfg.NodeID = cert.Subject.CommonName
 
+	if isServer && cfg.EnrollmentSigner != "" {
+		signerCert, signerKey, err := certificates.ReadCert(cfg.EnrollmentSigner, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if !certificates.HasRole(signerCert, certificates.RoleSigner) {
+			return nil, errors.New("enrollment_signer does not have the signer role")
+		}
+
+		if err := signerCert.CheckSignatureFrom(caCert); err != nil {
+			return nil, errors.New("enrollment_signer is not signed by our CA")
+		}
+
+		cfg.SignerCert = signerCert
+		cfg.SignerKey = signerKey
+	}
+
 	return &cfg, nil
 }
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+type UpstreamConfig struct {
+	Key string `json:"key"`
+
+	// relative share of connections for the weighted_round_robin selector
+	Weight int `json:"weight"`
+
+	// labels added to the ones reported by the upstream itself
+	Tags []string `json:"tags"`
+
+	// most concurrent connections through the upstream, 0 for no limit
+	MaxConnections int64 `json:"max_connections"`
+
+	// use the source IP seen by the tracker instead of the advertised one
+	UseSourceAddress bool `json:"use_source_address"`
+}
+
+func (uc *UpstreamConfig) UnmarshalJSON(data []byte) error {
+	// upstreams used to be a plain list of keys
+	var key string
+	if err := json.Unmarshal(data, &key); err == nil {
+		*uc = UpstreamConfig{Key: key}
+		return nil
+	}
+
+	type plainUpstreamConfig UpstreamConfig
+	return json.Unmarshal(data, (*plainUpstreamConfig)(uc))
+}
+
+func (uc *UpstreamConfig) Validate() error {
+	if uc.Key == "" {
+		return errors.New("upstream key cannot be empty")
+	}
+
+	if uc.Weight < 0 {
+		return errors.New("upstream weight cannot be negative")
+	}
+
+	if uc.MaxConnections < 0 {
+		return errors.New("upstream max_connections cannot be negative")
+	}
+
+	return nil
+}
+
+// ClientPolicy restricts the upstreams a client certificate may use
+type ClientPolicy struct {
+	// only upstreams carrying all these tags are selected
+	Tags []string `json:"tags"`
+}
@@ -0,0 +1,7 @@
+package config
+
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// only these events are sent, all of them when empty
+	Events []string `json:"events"`
+}
@@ -0,0 +1,98 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ca0s/despiste/config"
+	"github.com/ca0s/despiste/tracker"
+)
+
+func TestUpstreamDialerFeedsBreaker(t *testing.T) {
+	pki := newTestPKI(t)
+	destination := startEcho(t)
+
+	addresses := map[string]string{
+		"upstream-dead":     closedAddress(t),
+		"upstream-refusing": pki.startUpstream(t, "upstream-refusing", refuseDial),
+		"upstream-hanging":  hangingAddress(t),
+	}
+
+	cfg := &config.Config{
+		UpstreamDeadline: time.Minute,
+		AffinityTTL:      time.Minute,
+		BreakerThreshold: 2,
+		BreakerBackoff:   time.Minute,
+	}
+	for key := range addresses {
+		cfg.Upstreams = append(cfg.Upstreams, config.UpstreamConfig{Key: key})
+	}
+
+	selector, _ := tracker.NewSelector(tracker.SelectorRoundRobin)
+	affinity, _ := tracker.NewAffinity(tracker.AffinityNone, time.Minute)
+	ts := tracker.NewTrackerServer(cfg, selector, affinity, nil)
+
+	for key, address := range addresses {
+		err := ts.UpdateUpstreamKeepalive(key, &tracker.KeepAliveRequest{ClientKey: key, Address: address}, "127.0.0.1:40000", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dialer := pki.dialer(t, ts, UpstreamDialerOptions{Timeout: 5 * time.Second})
+
+	dial := func(key string, timeout time.Duration) error {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(timeout, cancel)
+		defer cancel()
+
+		conn, err := dialer.Dial(WithSelectionRequest(ctx, &tracker.SelectionRequest{Upstream: key}), "tcp", destination)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// whether the breaker still lets connections through the upstream
+	admitted := func(key string) bool {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		upstream, err := ts.GetUpstream(ctx, &tracker.SelectionRequest{Upstream: key})
+		if err != nil {
+			return false
+		}
+
+		upstream.ConnectionClosed()
+		return true
+	}
+
+	for i := 0; i < 3; i++ {
+		if dial("upstream-refusing", time.Minute) == nil {
+			t.Fatal("refused destination reached")
+		}
+
+		// the client giving up says nothing about the upstream
+		if dial("upstream-hanging", 50*time.Millisecond) == nil {
+			t.Fatal("hanging upstream reached")
+		}
+	}
+
+	for _, key := range []string{"upstream-refusing", "upstream-hanging"} {
+		if !admitted(key) {
+			t.Errorf("breaker of %s opened", key)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if dial("upstream-dead", time.Minute) == nil {
+			t.Fatal("dead upstream reached")
+		}
+	}
+
+	if admitted("upstream-dead") {
+		t.Error("breaker of upstream-dead did not open")
+	}
+
+}
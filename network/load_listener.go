@@ -0,0 +1,88 @@
+package network
+
+import (
+	"net"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/ca0s/despiste/tracker"
+)
+
+// LoadListener measures the load of the connections it accepts so an
+// upstream can report it to the tracker
+type LoadListener struct {
+	net.Listener
+
+	capacity          int64
+	activeConnections int64
+	bytesRelayed      int64
+}
+
+func NewLoadListener(listener net.Listener, capacity int64) *LoadListener {
+	return &LoadListener{
+		Listener: listener,
+		capacity: capacity,
+	}
+}
+
+func (l *LoadListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &loadConn{Conn: c, listener: l}, nil
+}
+
+// Load returns the current load, counting the bytes relayed since the
+// previous call
+func (l *LoadListener) Load() tracker.UpstreamLoad {
+	return tracker.UpstreamLoad{
+		ActiveConnections: atomic.LoadInt64(&l.activeConnections),
+		BytesRelayed:      atomic.SwapInt64(&l.bytesRelayed, 0),
+		Goroutines:        runtime.NumGoroutine(),
+		Capacity:          l.capacity,
+	}
+}
+
+const (
+	connIdle int32 = iota
+	connActive
+	connClosed
+)
+
+// loadConn only counts as active once the client sends something after our
+// first reply, the socks greeting. Health probes that stop at the greeting
+// are not load.
+type loadConn struct {
+	net.Conn
+
+	listener *LoadListener
+	replied  int32
+	state    int32
+}
+
+func (c *loadConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.listener.bytesRelayed, int64(n))
+
+	if n > 0 && atomic.LoadInt32(&c.replied) == 1 && atomic.CompareAndSwapInt32(&c.state, connIdle, connActive) {
+		atomic.AddInt64(&c.listener.activeConnections, 1)
+	}
+
+	return n, err
+}
+
+func (c *loadConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.listener.bytesRelayed, int64(n))
+	atomic.StoreInt32(&c.replied, 1)
+	return n, err
+}
+
+func (c *loadConn) Close() error {
+	if atomic.SwapInt32(&c.state, connClosed) == connActive {
+		atomic.AddInt64(&c.listener.activeConnections, -1)
+	}
+	return c.Conn.Close()
+}
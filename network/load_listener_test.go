@@ -0,0 +1,72 @@
+package network
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+func TestLoadListenerSkipsGreetings(t *testing.T) {
+	destination := startEcho(t)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := NewLoadListener(tcpListener, 0)
+	t.Cleanup(func() { listener.Close() })
+
+	server, err := socks5.New(&socks5.Config{Logger: log.New(io.Discard, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Serve(listener)
+
+	active := func(want int64) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for listener.Load().ActiveConnections != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d active connections, want %d", listener.Load().ActiveConnections, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	probe, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = socksGreet(context.Background(), probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active(0)
+	probe.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = socksConnect(context.Background(), conn, nil, destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEcho(t, conn)
+	active(1)
+
+	conn.Close()
+	active(0)
+}
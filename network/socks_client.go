@@ -0,0 +1,237 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socksVersion        = 5
+	socksAuthVersion    = 1
+	socksNoAuth         = 0
+	socksUserPassAuth   = 2
+	socksConnectCommand = 1
+	socksAddressIPv4    = 1
+	socksAddressFQDN    = 3
+	socksAddressIPv6    = 4
+	socksReplySucceeded = 0
+	socksMaxFieldLength = 255
+)
+
+var ErrSocksAuthFailed = errors.New("socks authentication failed")
+var ErrSocksNoAcceptableAuth = errors.New("no acceptable socks authentication method")
+
+var socksReplyMessages = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// SocksReplyError is a failure reported by the remote socks server about the
+// requested destination, as opposed to a failure reaching the server itself
+type SocksReplyError struct {
+	Code byte
+}
+
+func (e *SocksReplyError) Error() string {
+	if msg, ok := socksReplyMessages[e.Code]; ok {
+		return "socks: " + msg
+	}
+
+	return fmt.Sprintf("socks: unknown reply %d", e.Code)
+}
+
+type SocksCredentials struct {
+	Username string
+	Password string
+}
+
+// socksConnect runs the socks5 negotiation and CONNECT request for addr over
+// an already established connection. Credentials are optional, when given
+// they are the only auth method offered, as the server would otherwise be
+// free to settle on no authentication and never see the username.
+func socksConnect(ctx context.Context, conn net.Conn, credentials *SocksCredentials, addr string) error {
+	return withConnContext(ctx, conn, func() error {
+		err := socksNegotiate(conn, credentials)
+		if err != nil {
+			return err
+		}
+
+		return socksRequest(conn, addr)
+	})
+}
+
+// socksGreet only runs the socks5 method negotiation, enough to know the
+// remote end is a working socks server. conn is not reused afterwards.
+func socksGreet(ctx context.Context, conn net.Conn) error {
+	return withConnContext(ctx, conn, func() error {
+		return socksNegotiate(conn, nil)
+	})
+}
+
+// withConnContext runs f with the deadline and cancellation of ctx applied to
+// conn, and reports the context error when f failed because of it. The conn
+// is left without a deadline once it returns.
+func withConnContext(ctx context.Context, conn net.Conn, f func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		// unblock any pending read or write
+		conn.SetDeadline(time.Unix(1, 0))
+		close(cancelled)
+	})
+
+	err := f()
+
+	// the conn may be handed over right after, so the deadline must not be
+	// set behind our back once it has been cleared
+	if !stop() {
+		<-cancelled
+	}
+	conn.SetDeadline(time.Time{})
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+func socksNegotiate(conn net.Conn, credentials *SocksCredentials) error {
+	method := byte(socksNoAuth)
+	if credentials != nil {
+		method = socksUserPassAuth
+	}
+
+	_, err := conn.Write([]byte{socksVersion, 1, method})
+	if err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected socks version %d", reply[0])
+	}
+
+	if reply[1] != method {
+		return ErrSocksNoAcceptableAuth
+	}
+
+	if credentials == nil {
+		return nil
+	}
+
+	if len(credentials.Username) == 0 || len(credentials.Username) > socksMaxFieldLength ||
+		len(credentials.Password) == 0 || len(credentials.Password) > socksMaxFieldLength {
+		return errors.New("invalid socks username or password length")
+	}
+
+	request := []byte{socksAuthVersion, byte(len(credentials.Username))}
+	request = append(request, credentials.Username...)
+	request = append(request, byte(len(credentials.Password)))
+	request = append(request, credentials.Password...)
+
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+
+	if reply[1] != 0 {
+		return ErrSocksAuthFailed
+	}
+
+	return nil
+}
+
+func socksRequest(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	request := []byte{socksVersion, socksConnectCommand, 0}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > socksMaxFieldLength {
+			return fmt.Errorf("destination host %q is too long", host)
+		}
+		request = append(request, socksAddressFQDN, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socksAddressIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socksAddressIPv6)
+		request = append(request, ip.To16()...)
+	}
+
+	request = append(request, byte(port>>8), byte(port))
+
+	_, err = conn.Write(request)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+
+	if header[0] != socksVersion {
+		return fmt.Errorf("unexpected socks version %d", header[0])
+	}
+
+	if header[1] != socksReplySucceeded {
+		return &SocksReplyError{Code: header[1]}
+	}
+
+	// discard the bound address
+	var addrLength int
+	switch header[3] {
+	case socksAddressIPv4:
+		addrLength = net.IPv4len
+	case socksAddressIPv6:
+		addrLength = net.IPv6len
+	case socksAddressFQDN:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(conn, length)
+		if err != nil {
+			return err
+		}
+		addrLength = int(length[0])
+	default:
+		return fmt.Errorf("unknown socks address type %d", header[3])
+	}
+
+	_, err = io.ReadFull(conn, make([]byte, addrLength+2))
+	return err
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// fakeSocksServer answers a single socks5 negotiation on conn, accepting the
+// first offered method and replying code to the CONNECT request. It returns
+// the offered methods and the username/password request, if any.
+func fakeSocksServer(conn net.Conn, code byte) (methods []byte, auth []byte) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+
+	methods = make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	conn.Write([]byte{socksVersion, methods[0]})
+
+	if methods[0] == socksUserPassAuth {
+		auth = make([]byte, 2)
+		io.ReadFull(conn, auth)
+		username := make([]byte, auth[1]+1)
+		io.ReadFull(conn, username)
+		password := make([]byte, username[len(username)-1])
+		io.ReadFull(conn, password)
+		auth = append(append(auth, username...), password...)
+
+		conn.Write([]byte{socksAuthVersion, 0})
+	}
+
+	// version, command, reserved, IPv4 address and port
+	request := make([]byte, 10)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+
+	conn.Write([]byte{socksVersion, code, 0, socksAddressIPv4, 127, 0, 0, 1, 0, 80})
+	return
+}
+
+func TestSocksConnectMethods(t *testing.T) {
+	tests := []struct {
+		credentials *SocksCredentials
+		methods     []byte
+		auth        []byte
+	}{
+		{methods: []byte{socksNoAuth}},
+		{
+			credentials: &SocksCredentials{Username: "tag=eu", Password: "x"},
+			methods:     []byte{socksUserPassAuth},
+			auth:        []byte{socksAuthVersion, 6, 't', 'a', 'g', '=', 'e', 'u', 1, 'x'},
+		},
+	}
+
+	for _, test := range tests {
+		client, server := net.Pipe()
+
+		var methods, auth []byte
+		done := make(chan struct{})
+		go func() {
+			methods, auth = fakeSocksServer(server, socksReplySucceeded)
+			close(done)
+		}()
+
+		err := socksConnect(context.Background(), client, test.credentials, "127.0.0.1:80")
+		client.Close()
+		<-done
+
+		if err != nil {
+			t.Errorf("%+v: %s", test.credentials, err)
+		}
+
+		if !bytes.Equal(methods, test.methods) {
+			t.Errorf("%+v: offered methods %v, want %v", test.credentials, methods, test.methods)
+		}
+
+		if !bytes.Equal(auth, test.auth) {
+			t.Errorf("%+v: sent auth %v, want %v", test.credentials, auth, test.auth)
+		}
+	}
+}
+
+func TestSocksConnectReplies(t *testing.T) {
+	for _, code := range []byte{1, 2, 4, 5, 9} {
+		client, server := net.Pipe()
+		go fakeSocksServer(server, code)
+
+		err := socksConnect(context.Background(), client, nil, "127.0.0.1:80")
+		client.Close()
+
+		var replyErr *SocksReplyError
+		if !errors.As(err, &replyErr) || replyErr.Code != code {
+			t.Errorf("reply %d: got %v", code, err)
+		}
+	}
+}
+
+func TestSocksConnectRejectsEmptyPassword(t *testing.T) {
+	client, server := net.Pipe()
+	go fakeSocksServer(server, socksReplySucceeded)
+	defer client.Close()
+
+	err := socksConnect(context.Background(), client, &SocksCredentials{Username: "tag=eu"}, "127.0.0.1:80")
+	if err == nil {
+		t.Fatal("empty password accepted")
+	}
+}
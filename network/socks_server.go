@@ -0,0 +1,178 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/ca0s/despiste/tracker"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// forwardedPassword goes along with forwarded usernames. The server accepts
+// any password, but socks5 does not allow an empty one.
+const forwardedPassword = "despiste"
+
+type selectionRequestKey struct{}
+type socksCredentialsKey struct{}
+
+func WithSelectionRequest(ctx context.Context, request *tracker.SelectionRequest) context.Context {
+	return context.WithValue(ctx, selectionRequestKey{}, request)
+}
+
+func SelectionRequestFromContext(ctx context.Context) *tracker.SelectionRequest {
+	request, _ := ctx.Value(selectionRequestKey{}).(*tracker.SelectionRequest)
+	return request
+}
+
+func WithSocksCredentials(ctx context.Context, credentials *SocksCredentials) context.Context {
+	return context.WithValue(ctx, socksCredentialsKey{}, credentials)
+}
+
+func SocksCredentialsFromContext(ctx context.Context) *SocksCredentials {
+	credentials, _ := ctx.Value(socksCredentialsKey{}).(*SocksCredentials)
+	return credentials
+}
+
+// SocksServer serves socks5 over TLS connections and exposes the identity of
+// the client certificate to the dialer through the request context
+type SocksServer struct {
+	config socks5.Config
+}
+
+func NewSocksServer(conf socks5.Config) *SocksServer {
+	if conf.Rules == nil {
+		conf.Rules = socks5.PermitAll()
+	}
+
+	if conf.Logger == nil {
+		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
+	}
+
+	return &SocksServer{
+		config: conf,
+	}
+}
+
+func (s *SocksServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.ServeConn(conn)
+	}
+}
+
+func (s *SocksServer) ServeConn(conn net.Conn) error {
+	identity, err := connIdentity(conn)
+	if err != nil {
+		log.Printf("handshake with %s failed: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return err
+	}
+
+	// the socks5 server only passes the request to its rules, so every
+	// connection gets its own rule set carrying the client identity
+	conf := s.config
+	conf.Rules = &identityRules{
+		RuleSet:  s.config.Rules,
+		identity: identity,
+	}
+
+	server, err := socks5.New(&conf)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	return server.ServeConn(conn)
+}
+
+func connIdentity(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	err := tlsConn.Handshake()
+	if err != nil {
+		return "", err
+	}
+
+	tlsConn.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return "", nil
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
+type identityRules struct {
+	socks5.RuleSet
+	identity string
+}
+
+func (r *identityRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := r.RuleSet.Allow(ctx, req)
+	if !ok {
+		return ctx, false
+	}
+
+	destination := req.DestAddr.FQDN
+	if destination == "" {
+		destination = req.DestAddr.IP.String()
+	}
+
+	request := &tracker.SelectionRequest{
+		ClientID:    r.identity,
+		Destination: destination,
+	}
+
+	if username := requestUsername(req); username != "" {
+		err := ParseUsername(username, request)
+		if err != nil {
+			log.Printf("rejecting request from %s: %s\n", r.identity, err)
+			return ctx, false
+		}
+	}
+
+	return WithSelectionRequest(ctx, request), true
+}
+
+// ForwardUsernameRules hands the socks5 username of each request to the
+// dialer, so a local proxy can pass it on to the server
+type ForwardUsernameRules struct {
+	socks5.RuleSet
+}
+
+func (r *ForwardUsernameRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := r.RuleSet.Allow(ctx, req)
+	if !ok {
+		return ctx, false
+	}
+
+	if username := requestUsername(req); username != "" {
+		ctx = WithSocksCredentials(ctx, &SocksCredentials{Username: username, Password: forwardedPassword})
+	}
+
+	return ctx, true
+}
+
+func requestUsername(req *socks5.Request) string {
+	if req.AuthContext == nil || req.AuthContext.Method != socks5.UserPassAuth {
+		return ""
+	}
+
+	return req.AuthContext.Payload["Username"]
+}
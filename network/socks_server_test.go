@@ -0,0 +1,197 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/config"
+	"github.com/ca0s/despiste/tracker"
+)
+
+// startServer runs a SocksServer configured like cmd/server, handing out
+// the upstreams of provider
+func (p *testPKI) startServer(tb testing.TB, provider UpstreamProvider) string {
+	tb.Helper()
+
+	cert, key := p.issue(tb, certificates.RoleServer, "server")
+
+	listener, err := NewTLSListener("127.0.0.1:0", p.ca, cert, key, nil, nil, certificates.RoleClient)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+
+	server := NewSocksServer(socks5.Config{
+		AuthMethods: []socks5.Authenticator{
+			socks5.NoAuthAuthenticator{},
+			socks5.UserPassAuthenticator{Credentials: UsernameCredentials{}},
+		},
+		Dial:   p.dialer(tb, provider, UpstreamDialerOptions{Timeout: 10 * time.Second}).Dial,
+		Logger: log.New(io.Discard, "", 0),
+	})
+
+	go server.Serve(listener)
+
+	return listener.Addr().String()
+}
+
+// clientDialer reaches the server at address as a client, like cmd/despiste
+func (p *testPKI) clientDialer(tb testing.TB, address string) *UpstreamDialer {
+	tb.Helper()
+
+	cert, key := p.issue(tb, certificates.RoleClient, "client")
+	provider := &stubProvider{upstreams: []*tracker.Upstream{tracker.NewUpstream("server", address)}}
+
+	dialer, err := NewUpstreamDialer(provider, p.ca, cert, key, nil, certificates.RoleServer, UpstreamDialerOptions{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return dialer
+}
+
+func TestSocksServerUsernameSelection(t *testing.T) {
+	pki := newTestPKI(t)
+	destination := startEcho(t)
+
+	addresses := []string{
+		pki.startUpstream(t, "upstream-us", directDial),
+		pki.startUpstream(t, "upstream-eu", directDial),
+	}
+
+	newProvider := func() *stubProvider {
+		return &stubProvider{upstreams: []*tracker.Upstream{
+			tracker.NewUpstream("upstream-us", addresses[0]),
+			tracker.NewUpstream("upstream-eu", addresses[1]),
+		}}
+	}
+
+	checkRequest := func(t *testing.T, provider *stubProvider) {
+		t.Helper()
+
+		provider.lock.Lock()
+		defer provider.lock.Unlock()
+
+		if len(provider.requests) != 1 {
+			t.Fatalf("%d selections", len(provider.requests))
+		}
+
+		request := provider.requests[0]
+		if request.ClientID != "client" || request.Upstream != "upstream-eu" || request.Session != "abc" || !slices.Equal(request.Tags, []string{"eu"}) {
+			t.Errorf("got %+v", request)
+		}
+
+		if provider.upstreams[1].ActiveConnections() != 1 {
+			t.Errorf("connection not made through upstream-eu")
+		}
+	}
+
+	username := "upstream=upstream-eu,session=abc,tag=eu"
+
+	t.Run("username sent to the server", func(t *testing.T) {
+		provider := newProvider()
+		client := pki.clientDialer(t, pki.startServer(t, provider))
+
+		ctx := WithSocksCredentials(context.Background(), &SocksCredentials{Username: username, Password: "x"})
+		conn, err := client.Dial(ctx, "tcp", destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		checkEcho(t, conn)
+		checkRequest(t, provider)
+	})
+
+	t.Run("username forwarded by a local proxy", func(t *testing.T) {
+		provider := newProvider()
+		client := pki.clientDialer(t, pki.startServer(t, provider))
+
+		local, err := socks5.New(&socks5.Config{
+			AuthMethods: []socks5.Authenticator{
+				socks5.UserPassAuthenticator{Credentials: UsernameCredentials{}},
+			},
+			Rules:  &ForwardUsernameRules{RuleSet: socks5.PermitAll()},
+			Dial:   client.Dial,
+			Logger: log.New(io.Discard, "", 0),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		go local.Serve(listener)
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		err = socksConnect(context.Background(), conn, &SocksCredentials{Username: username, Password: "x"}, destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkEcho(t, conn)
+		checkRequest(t, provider)
+	})
+}
+
+func TestSocksServerQueueTimeout(t *testing.T) {
+	pki := newTestPKI(t)
+	destination := startEcho(t)
+
+	cfg := &config.Config{
+		UpstreamDeadline: time.Minute,
+		QueueTimeout:     50 * time.Millisecond,
+		Upstreams:        []config.UpstreamConfig{{Key: "upstream-0", MaxConnections: 1}},
+	}
+
+	selector, _ := tracker.NewSelector(tracker.SelectorRoundRobin)
+	affinity, _ := tracker.NewAffinity(tracker.AffinityNone, 0)
+	ts := tracker.NewTrackerServer(cfg, selector, affinity, nil)
+
+	err := ts.UpdateUpstreamKeepalive("upstream-0", &tracker.KeepAliveRequest{
+		ClientKey: "upstream-0",
+		Address:   pki.startUpstream(t, "upstream-0", directDial),
+	}, "127.0.0.1:40000", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := pki.clientDialer(t, pki.startServer(t, ts))
+
+	conn, err := client.Dial(context.Background(), "tcp", destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	checkEcho(t, conn)
+
+	start := time.Now()
+	_, err = client.Dial(context.Background(), "tcp", destination)
+
+	var replyErr *SocksReplyError
+	if !errors.As(err, &replyErr) || replyErr.Code != 4 {
+		t.Fatalf("got %v, want a host unreachable reply", err)
+	}
+
+	if waited := time.Since(start); waited < cfg.QueueTimeout {
+		t.Errorf("failed after %s, before the queue timeout", waited)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"net"
+
+	"github.com/ca0s/despiste/certificates"
 )
 
 type TLSDialer struct {
@@ -13,12 +15,15 @@ type TLSDialer struct {
 	clientCert    *x509.Certificate
 	clientKey     *ecdsa.PrivateKey
 	tlsCertficate *tls.Certificate
+	revocation    *certificates.RevocationChecker
+	// the server must present a certificate with one of these
+	roles []string
 
 	serverName string
 	tlsDialer  *tls.Dialer
 }
 
-func NewTLSDialer(caCert *x509.Certificate, clientCert *x509.Certificate, clientKey *ecdsa.PrivateKey) (*TLSDialer, error) {
+func NewTLSDialer(caCert *x509.Certificate, clientCert *x509.Certificate, clientKey *ecdsa.PrivateKey, revocation *certificates.RevocationChecker, roles ...string) (*TLSDialer, error) {
 	var tlsCert tls.Certificate
 	tlsCert.Certificate = append(tlsCert.Certificate, clientCert.Raw)
 	tlsCert.PrivateKey = clientKey
@@ -28,16 +33,14 @@ func NewTLSDialer(caCert *x509.Certificate, clientCert *x509.Certificate, client
 		clientCert:    clientCert,
 		clientKey:     clientKey,
 		tlsCertficate: &tlsCert,
+		revocation:    revocation,
+		roles:         roles,
 	}
 
 	dialer.rootCAs.AddCert(caCert)
 
 	dialer.tlsDialer = &tls.Dialer{
-		Config: &tls.Config{
-			MinVersion:   tls.VersionTLS13,
-			RootCAs:      dialer.rootCAs,
-			Certificates: []tls.Certificate{*dialer.tlsCertficate},
-		},
+		Config: dialer.tlsConfig(""),
 	}
 
 	return dialer, nil
@@ -57,16 +60,26 @@ func (d *TLSDialer) ForServerName(name string) *TLSDialer {
 		clientCert:    d.clientCert,
 		clientKey:     d.clientKey,
 		tlsCertficate: d.tlsCertficate,
+		revocation:    d.revocation,
+		roles:         d.roles,
 
 		serverName: name,
 
 		tlsDialer: &tls.Dialer{
-			Config: &tls.Config{
-				MinVersion:   tls.VersionTLS13,
-				RootCAs:      d.rootCAs,
-				Certificates: []tls.Certificate{*d.tlsCertficate},
-				ServerName:   name,
-			},
+			Config: d.tlsConfig(name),
 		},
 	}
 }
+
+func (d *TLSDialer) tlsConfig(serverName string) *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		RootCAs:      d.rootCAs,
+		Certificates: []tls.Certificate{*d.tlsCertficate},
+		ServerName:   serverName,
+
+		VerifyPeerCertificate: certificates.VerifyPeer(d.revocation, d.roles...),
+	}
+
+	return tlsConfig
+}
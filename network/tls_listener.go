@@ -5,21 +5,36 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"net"
+
+	"github.com/ca0s/despiste/certificates"
 )
 
-func NewTLSListener(addr string, caCert *x509.Certificate, clientCert *x509.Certificate, clientKey *ecdsa.PrivateKey) (net.Listener, error) {
+// NewTLSServerConfig only accepts clients whose certificate carries one of
+// roles. The chain of intermediates, if any, is presented after serverCert.
+func NewTLSServerConfig(caCert *x509.Certificate, serverCert *x509.Certificate, serverKey *ecdsa.PrivateKey, chain []*x509.Certificate, revocation *certificates.RevocationChecker, roles ...string) *tls.Config {
 	roots := x509.NewCertPool()
 	roots.AddCert(caCert)
 
 	var cert tls.Certificate
-	cert.Certificate = append(cert.Certificate, clientCert.Raw)
-	cert.PrivateKey = clientKey
+	cert.Certificate = append(cert.Certificate, serverCert.Raw)
+	for _, intermediate := range chain {
+		cert.Certificate = append(cert.Certificate, intermediate.Raw)
+	}
+	cert.PrivateKey = serverKey
 
-	return tls.Listen("tcp", addr, &tls.Config{
+	tlsConfig := &tls.Config{
 		MinVersion:   tls.VersionTLS13,
 		RootCAs:      roots,
 		ClientCAs:    roots,
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		Certificates: []tls.Certificate{cert},
-	})
+
+		VerifyPeerCertificate: certificates.VerifyPeer(revocation, roles...),
+	}
+
+	return tlsConfig
+}
+
+func NewTLSListener(addr string, caCert *x509.Certificate, clientCert *x509.Certificate, clientKey *ecdsa.PrivateKey, chain []*x509.Certificate, revocation *certificates.RevocationChecker, roles ...string) (net.Listener, error) {
+	return tls.Listen("tcp", addr, NewTLSServerConfig(caCert, clientCert, clientKey, chain, revocation, roles...))
 }
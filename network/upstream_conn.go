@@ -0,0 +1,50 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ca0s/despiste/tracker"
+)
+
+// trackedConn releases the connection slot reserved on its upstream and
+// reports the traffic it moved once closed
+type trackedConn struct {
+	net.Conn
+
+	upstream  *tracker.Upstream
+	opened    time.Time
+	sent      int64
+	received  int64
+	closeOnce sync.Once
+}
+
+func newTrackedConn(conn net.Conn, upstream *tracker.Upstream) *trackedConn {
+	return &trackedConn{
+		Conn:     conn,
+		upstream: upstream,
+		opened:   time.Now(),
+	}
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.received, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.sent, int64(n))
+	return n, err
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.upstream.ConnectionClosed()
+		c.upstream.ObserveTransfer(atomic.LoadInt64(&c.sent), atomic.LoadInt64(&c.received), time.Since(c.opened))
+	})
+	return c.Conn.Close()
+}
@@ -4,23 +4,38 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"crypto/x509"
+	"errors"
+	"log"
 	"net"
+	"time"
 
+	"github.com/ca0s/despiste/certificates"
 	"github.com/ca0s/despiste/tracker"
-	"golang.org/x/net/proxy"
 )
 
 type UpstreamDialer struct {
 	upstreamProvider UpstreamProvider
 	tlsDialer        *TLSDialer
+	options          UpstreamDialerOptions
 }
 
+type UpstreamDialerOptions struct {
+	// how many other upstreams to try when reaching one fails
+	Retries int
+	// total time allowed to reach the destination, retries included
+	Timeout time.Duration
+}
+
+// UpstreamProvider returns upstreams with a connection slot reserved, which
+// the dialer releases with ConnectionClosed
 type UpstreamProvider interface {
-	GetUpstream() (*tracker.Upstream, error)
+	GetUpstream(ctx context.Context, request *tracker.SelectionRequest) (*tracker.Upstream, error)
 }
 
-func NewUpstreamDialer(provider UpstreamProvider, caCert *x509.Certificate, clientCert *x509.Certificate, clientKey *ecdsa.PrivateKey) (*UpstreamDialer, error) {
-	tlsDialer, err := NewTLSDialer(caCert, clientCert, clientKey)
+// NewUpstreamDialer connects through upstreams presenting a certificate with
+// peerRole
+func NewUpstreamDialer(provider UpstreamProvider, caCert *x509.Certificate, clientCert *x509.Certificate, clientKey *ecdsa.PrivateKey, revocation *certificates.RevocationChecker, peerRole string, options UpstreamDialerOptions) (*UpstreamDialer, error) {
+	tlsDialer, err := NewTLSDialer(caCert, clientCert, clientKey, revocation, peerRole)
 	if err != nil {
 		return nil, err
 	}
@@ -28,23 +43,135 @@ func NewUpstreamDialer(provider UpstreamProvider, caCert *x509.Certificate, clie
 	return &UpstreamDialer{
 		upstreamProvider: provider,
 		tlsDialer:        tlsDialer,
+		options:          options,
 	}, nil
 }
 
 func (us *UpstreamDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
-	upstream, err := us.upstreamProvider.GetUpstream()
+	if us.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, us.options.Timeout)
+		defer cancel()
+	}
+
+	request := tracker.SelectionRequest{}
+	if contextRequest := SelectionRequestFromContext(ctx); contextRequest != nil {
+		request = *contextRequest
+	}
+
+	var lastErr error
+
+	for attempt := 0; attempt <= us.options.Retries; attempt++ {
+		selectCtx := ctx
+		if attempt > 0 {
+			// retries only take an upstream that is available right away
+			selectCtx = doneContext(ctx)
+		}
+
+		upstream, err := us.upstreamProvider.GetUpstream(selectCtx, &request)
+		if err != nil {
+			if lastErr != nil {
+				// no other upstream to try, the dial error is more useful
+				return nil, lastErr
+			}
+			return nil, err
+		}
+
+		attemptCtx, cancel := attemptContext(ctx, us.options.Retries-attempt+1)
+		conn, err := us.dialUpstream(attemptCtx, upstream, addr)
+		cancel()
+
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+
+		// a client asking for an upstream by name gets no other
+		if !isRetryable(err) || ctx.Err() != nil || request.Upstream != "" {
+			break
+		}
+
+		log.Printf("could not reach %s through upstream %s: %s\n", addr, upstream.Key, err)
+
+		request.Exclude = append(request.Exclude[:len(request.Exclude):len(request.Exclude)], upstream.Key)
+	}
+
+	return nil, lastErr
+}
+
+func (us *UpstreamDialer) dialUpstream(ctx context.Context, upstream *tracker.Upstream, addr string) (net.Conn, error) {
+	conn, err := us.dialSocks(ctx, upstream, addr)
 	if err != nil {
+		upstream.ConnectionClosed()
 		return nil, err
 	}
 
-	dialSocksProxy, err := proxy.SOCKS5(network, upstream.Address, nil, us.tlsDialer.ForServerName(upstream.Key))
+	return newTrackedConn(conn, upstream), nil
+}
+
+func (us *UpstreamDialer) dialSocks(ctx context.Context, upstream *tracker.Upstream, addr string) (conn net.Conn, err error) {
+	defer func() {
+		us.reportDial(ctx, upstream, err)
+	}()
+
+	start := time.Now()
+
+	conn, err = us.tlsDialer.ForServerName(upstream.Key).DialContext(ctx, "tcp", upstream.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream.ObserveHandshake(time.Since(start))
+
+	start = time.Now()
+
+	err = socksConnect(ctx, conn, SocksCredentialsFromContext(ctx), addr)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	ctxDialer := (dialSocksProxy).(interface {
-		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
-	})
+	upstream.ObserveConnect(time.Since(start))
+
+	return conn, nil
+}
+
+// reportDial feeds the upstream circuit breaker. Destination errors mean the
+// upstream itself works, and dials cancelled by the client say nothing.
+func (us *UpstreamDialer) reportDial(ctx context.Context, upstream *tracker.Upstream, err error) {
+	switch {
+	case err == nil || !isRetryable(err):
+		upstream.DialSucceeded()
+	case errors.Is(ctx.Err(), context.Canceled):
+		upstream.DialAborted()
+	default:
+		upstream.DialFailed()
+	}
+}
+
+// attemptContext splits the remaining time of ctx evenly among the attempts
+// left, so a hanging upstream does not use up the whole budget
+func attemptContext(ctx context.Context, attemptsLeft int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || attemptsLeft <= 1 {
+		return context.WithCancel(ctx)
+	}
+
+	share := time.Until(deadline) / time.Duration(attemptsLeft)
+	return context.WithTimeout(ctx, share)
+}
+
+// doneContext returns an already cancelled child of ctx
+func doneContext(ctx context.Context) context.Context {
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	return done
+}
 
-	return ctxDialer.DialContext(ctx, network, addr)
+// isRetryable tells failures to reach or talk to an upstream apart from
+// errors the upstream reports about the destination itself
+func isRetryable(err error) bool {
+	var replyErr *SocksReplyError
+	return !errors.As(err, &replyErr)
 }
@@ -0,0 +1,344 @@
+package network
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/tracker"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+type testPKI struct {
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+}
+
+func newTestPKI(tb testing.TB) *testPKI {
+	tb.Helper()
+
+	now := time.Now()
+
+	caBlock, caKeyBlock, err := certificates.GenerateCert(certificates.RoleCA, nil, nil, 1, "ca", now, now.Add(time.Hour))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ca, _ := x509.ParseCertificate(caBlock.Bytes)
+	caKey, _ := x509.ParseECPrivateKey(caKeyBlock.Bytes)
+
+	return &testPKI{ca: ca, caKey: caKey}
+}
+
+func (p *testPKI) issue(tb testing.TB, role string, subject string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	tb.Helper()
+
+	now := time.Now()
+
+	block, keyBlock, err := certificates.GenerateCert(role, p.ca, p.caKey, now.UnixNano(), subject, now, now.Add(time.Hour))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(block.Bytes)
+	key, _ := x509.ParseECPrivateKey(keyBlock.Bytes)
+
+	return cert, key
+}
+
+func (p *testPKI) dialer(tb testing.TB, provider UpstreamProvider, options UpstreamDialerOptions) *UpstreamDialer {
+	tb.Helper()
+
+	cert, key := p.issue(tb, certificates.RoleServer, "server")
+
+	dialer, err := NewUpstreamDialer(provider, p.ca, cert, key, nil, certificates.RoleUpstream, options)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return dialer
+}
+
+// startUpstream serves socks5 over TLS as the upstream key, reaching
+// destinations with dial
+func (p *testPKI) startUpstream(tb testing.TB, key string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) string {
+	tb.Helper()
+
+	cert, certKey := p.issue(tb, certificates.RoleUpstream, key)
+
+	listener, err := NewTLSListener("127.0.0.1:0", p.ca, cert, certKey, nil, nil, certificates.RoleServer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+
+	server, err := socks5.New(&socks5.Config{
+		Dial:   dial,
+		Logger: log.New(io.Discard, "", 0),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	go server.Serve(listener)
+
+	return listener.Addr().String()
+}
+
+// startEcho returns the address of a destination echoing what it gets
+func startEcho(tb testing.TB) string {
+	tb.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// closedAddress returns an address nothing listens on
+func closedAddress(tb testing.TB) string {
+	tb.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	address := listener.Addr().String()
+	listener.Close()
+
+	return address
+}
+
+// hangingAddress accepts connections and never answers
+func hangingAddress(tb testing.TB) string {
+	tb.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func refuseDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, errors.New("connection refused")
+}
+
+func directDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// stubProvider hands out its upstreams in order, skipping excluded ones, and
+// keeps the requests it got
+type stubProvider struct {
+	lock      sync.Mutex
+	upstreams []*tracker.Upstream
+	calls     int
+	requests  []tracker.SelectionRequest
+}
+
+func (p *stubProvider) GetUpstream(ctx context.Context, request *tracker.SelectionRequest) (*tracker.Upstream, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.calls++
+	p.requests = append(p.requests, *request)
+
+	for _, upstream := range p.upstreams {
+		if slices.Contains(request.Exclude, upstream.Key) {
+			continue
+		}
+
+		if request.Upstream != "" && request.Upstream != upstream.Key {
+			continue
+		}
+
+		upstream.ConnectionOpened()
+		return upstream, nil
+	}
+
+	return nil, tracker.ErrNoUpstreamsAvailable
+}
+
+func checkEcho(tb testing.TB, conn net.Conn) {
+	tb.Helper()
+
+	_, err := conn.Write([]byte("ping"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	reply := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || string(reply) != "ping" {
+		tb.Fatalf("got %q: %v", reply, err)
+	}
+}
+
+func TestUpstreamDialerRetries(t *testing.T) {
+	pki := newTestPKI(t)
+	destination := startEcho(t)
+
+	dead := tracker.NewUpstream("upstream-dead", closedAddress(t))
+	refusing := tracker.NewUpstream("upstream-refusing", pki.startUpstream(t, "upstream-refusing", refuseDial))
+	working := tracker.NewUpstream("upstream-ok", pki.startUpstream(t, "upstream-ok", directDial))
+
+	options := UpstreamDialerOptions{Retries: 2, Timeout: 10 * time.Second}
+
+	t.Run("unreachable upstream", func(t *testing.T) {
+		provider := &stubProvider{upstreams: []*tracker.Upstream{dead, working}}
+
+		conn, err := pki.dialer(t, provider, options).Dial(context.Background(), "tcp", destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		checkEcho(t, conn)
+
+		if provider.calls != 2 || dead.ActiveConnections() != 0 || working.ActiveConnections() != 1 {
+			t.Errorf("%d selections, %d and %d connections", provider.calls, dead.ActiveConnections(), working.ActiveConnections())
+		}
+
+		conn.Close()
+
+		if working.ActiveConnections() != 0 {
+			t.Errorf("connection slot not released")
+		}
+	})
+
+	t.Run("destination refused", func(t *testing.T) {
+		provider := &stubProvider{upstreams: []*tracker.Upstream{refusing, working}}
+
+		_, err := pki.dialer(t, provider, options).Dial(context.Background(), "tcp", destination)
+
+		var replyErr *SocksReplyError
+		if !errors.As(err, &replyErr) || replyErr.Code != 5 {
+			t.Fatalf("got %v, want a connection refused reply", err)
+		}
+
+		// the destination would refuse any other upstream too
+		if provider.calls != 1 || refusing.ActiveConnections() != 0 {
+			t.Errorf("%d selections, %d connections left", provider.calls, refusing.ActiveConnections())
+		}
+	})
+
+	t.Run("named upstream", func(t *testing.T) {
+		provider := &stubProvider{upstreams: []*tracker.Upstream{dead, working}}
+		ctx := WithSelectionRequest(context.Background(), &tracker.SelectionRequest{Upstream: dead.Key})
+
+		_, err := pki.dialer(t, provider, options).Dial(ctx, "tcp", destination)
+		if err == nil || provider.calls != 1 {
+			t.Errorf("%d selections: %v", provider.calls, err)
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		provider := &stubProvider{upstreams: []*tracker.Upstream{dead, tracker.NewUpstream("upstream-dead-2", closedAddress(t)), working}}
+
+		_, err := pki.dialer(t, provider, UpstreamDialerOptions{Retries: 1, Timeout: options.Timeout}).Dial(context.Background(), "tcp", destination)
+		if err == nil || provider.calls != 2 {
+			t.Errorf("%d selections: %v", provider.calls, err)
+		}
+	})
+}
+
+func TestUpstreamDialerSplitsTimeout(t *testing.T) {
+	pki := newTestPKI(t)
+	destination := startEcho(t)
+
+	hanging := tracker.NewUpstream("upstream-hanging", hangingAddress(t))
+	working := tracker.NewUpstream("upstream-ok", pki.startUpstream(t, "upstream-ok", directDial))
+
+	provider := &stubProvider{upstreams: []*tracker.Upstream{hanging, working}}
+	timeout := 2 * time.Second
+
+	start := time.Now()
+
+	// the hanging upstream only gets half of the time, leaving some for the retry
+	conn, err := pki.dialer(t, provider, UpstreamDialerOptions{Retries: 1, Timeout: timeout}).Dial(context.Background(), "tcp", destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	checkEcho(t, conn)
+
+	if elapsed := time.Since(start); elapsed < timeout/2-100*time.Millisecond || elapsed > timeout {
+		t.Errorf("dial took %s", elapsed)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{err: &SocksReplyError{Code: 5}, retryable: false},
+		{err: fmt.Errorf("dial: %w", &SocksReplyError{Code: 4}), retryable: false},
+		{err: io.EOF, retryable: true},
+		{err: context.DeadlineExceeded, retryable: true},
+		{err: ErrSocksNoAcceptableAuth, retryable: true},
+		{err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, retryable: true},
+	}
+
+	for _, test := range tests {
+		if isRetryable(test.err) != test.retryable {
+			t.Errorf("%v: retryable %t", test.err, !test.retryable)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/tracker"
+)
+
+type UpstreamProber struct {
+	targets   ProbeTargetProvider
+	tlsDialer *TLSDialer
+	options   UpstreamProberOptions
+}
+
+type UpstreamProberOptions struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	// when set, probes CONNECT here instead of stopping at the socks greeting
+	Destination string
+}
+
+type ProbeTargetProvider interface {
+	ProbeTargets() []tracker.ProbeTarget
+	ReportProbe(key string, err error)
+}
+
+func NewUpstreamProber(targets ProbeTargetProvider, caCert *x509.Certificate, clientCert *x509.Certificate, clientKey *ecdsa.PrivateKey, revocation *certificates.RevocationChecker, options UpstreamProberOptions) (*UpstreamProber, error) {
+	tlsDialer, err := NewTLSDialer(caCert, clientCert, clientKey, revocation, certificates.RoleUpstream)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UpstreamProber{
+		targets:   targets,
+		tlsDialer: tlsDialer,
+		options:   options,
+	}, nil
+}
+
+// Run probes every upstream each interval. A round waits for its slowest
+// probe, so probes never pile up on a hanging upstream.
+func (p *UpstreamProber) Run() {
+	for {
+		var wg sync.WaitGroup
+
+		for _, target := range p.targets.ProbeTargets() {
+			wg.Add(1)
+			go func(target tracker.ProbeTarget) {
+				defer wg.Done()
+				p.targets.ReportProbe(target.Key, p.Probe(target))
+			}(target)
+		}
+
+		wg.Wait()
+		time.Sleep(p.options.Interval)
+	}
+}
+
+// Probe runs a TLS handshake and a socks5 greeting against the upstream, and
+// a CONNECT to the canary destination if one is configured
+func (p *UpstreamProber) Probe(target tracker.ProbeTarget) error {
+	ctx := context.Background()
+	if p.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.options.Timeout)
+		defer cancel()
+	}
+
+	conn, err := p.tlsDialer.ForServerName(target.Key).DialContext(ctx, "tcp", target.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if p.options.Destination == "" {
+		return socksGreet(ctx, conn)
+	}
+
+	return socksConnect(ctx, conn, nil, p.options.Destination)
+}
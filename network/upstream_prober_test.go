@@ -0,0 +1,99 @@
+package network
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/tracker"
+)
+
+// startTLSOnly completes TLS handshakes as the upstream key and hangs up
+func (p *testPKI) startTLSOnly(tb testing.TB, key string) string {
+	tb.Helper()
+
+	cert, certKey := p.issue(tb, certificates.RoleUpstream, key)
+
+	listener, err := NewTLSListener("127.0.0.1:0", p.ca, cert, certKey, nil, nil, certificates.RoleServer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestUpstreamProber(t *testing.T) {
+	pki := newTestPKI(t)
+	destination := startEcho(t)
+
+	targets := map[string]string{
+		"upstream-ok":       pki.startUpstream(t, "upstream-ok", directDial),
+		"upstream-refusing": pki.startUpstream(t, "upstream-refusing", refuseDial),
+		"upstream-dead":     closedAddress(t),
+		"upstream-hanging":  hangingAddress(t),
+		"upstream-tls-only": pki.startTLSOnly(t, "upstream-tls-only"),
+	}
+
+	cert, key := pki.issue(t, certificates.RoleServer, "server")
+
+	tests := []struct {
+		destination string
+		healthy     []string
+	}{
+		// the greeting does not reach any destination
+		{healthy: []string{"upstream-ok", "upstream-refusing"}},
+		{destination: destination, healthy: []string{"upstream-ok"}},
+	}
+
+	for _, test := range tests {
+		prober, err := NewUpstreamProber(nil, pki.ca, cert, key, nil, UpstreamProberOptions{
+			Timeout:     200 * time.Millisecond,
+			Destination: test.destination,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for target, address := range targets {
+			start := time.Now()
+			err := prober.Probe(tracker.ProbeTarget{Key: target, Address: address})
+
+			healthy := false
+			for _, key := range test.healthy {
+				healthy = healthy || key == target
+			}
+
+			if (err == nil) != healthy {
+				t.Errorf("probe of %s with destination %q: %v", target, test.destination, err)
+			}
+
+			if time.Since(start) > time.Second {
+				t.Errorf("probe of %s took %s", target, time.Since(start))
+			}
+		}
+
+		if test.destination != "" {
+			err := prober.Probe(tracker.ProbeTarget{Key: "upstream-refusing", Address: targets["upstream-refusing"]})
+
+			var replyErr *SocksReplyError
+			if !errors.As(err, &replyErr) {
+				t.Errorf("refused canary reported as %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ca0s/despiste/tracker"
+)
+
+const (
+	UsernameUpstream = "upstream"
+	UsernameSession  = "session"
+	UsernameTag      = "tag"
+)
+
+// ParseUsername reads upstream selectors from a socks5 username such as
+// "upstream=proxy1", "session=abc" or "tag=eu", separated by commas. Tags
+// can be repeated and must all be present on the selected upstream.
+func ParseUsername(username string, request *tracker.SelectionRequest) error {
+	for _, field := range strings.Split(username, ",") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || value == "" {
+			return fmt.Errorf("invalid username selector %q", field)
+		}
+
+		switch key {
+		case UsernameUpstream:
+			request.Upstream = value
+		case UsernameSession:
+			request.Session = value
+		case UsernameTag:
+			request.Tags = append(request.Tags, value)
+		default:
+			return fmt.Errorf("unknown username selector %q", key)
+		}
+	}
+
+	return nil
+}
+
+// UsernameCredentials accepts any password as long as the username is a
+// valid list of selectors. Clients are already authenticated by their
+// certificate, the username only expresses a preference.
+type UsernameCredentials struct{}
+
+func (UsernameCredentials) Valid(user, password string) bool {
+	return ParseUsername(user, &tracker.SelectionRequest{}) == nil
+}
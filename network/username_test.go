@@ -0,0 +1,50 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ca0s/despiste/tracker"
+)
+
+func TestParseUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		want     tracker.SelectionRequest
+		invalid  bool
+	}{
+		{username: "upstream=proxy1", want: tracker.SelectionRequest{Upstream: "proxy1"}},
+		{username: "session=abc", want: tracker.SelectionRequest{Session: "abc"}},
+		{username: "tag=eu,tag=residential", want: tracker.SelectionRequest{Tags: []string{"eu", "residential"}}},
+		{username: "session=abc,tag=eu,upstream=proxy1", want: tracker.SelectionRequest{Upstream: "proxy1", Session: "abc", Tags: []string{"eu"}}},
+		{username: "", invalid: true},
+		{username: "proxy1", invalid: true},
+		{username: "upstream=", invalid: true},
+		{username: "tag=eu,", invalid: true},
+		{username: "exit=proxy1", invalid: true},
+	}
+
+	for _, test := range tests {
+		var request tracker.SelectionRequest
+
+		err := ParseUsername(test.username, &request)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q accepted as %+v", test.username, request)
+			}
+			if (UsernameCredentials{}).Valid(test.username, "x") {
+				t.Errorf("%q valid as credentials", test.username)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %s", test.username, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(request, test.want) {
+			t.Errorf("%q parsed as %+v, want %+v", test.username, request, test.want)
+		}
+	}
+}
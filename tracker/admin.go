@@ -0,0 +1,185 @@
+package tracker
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/config"
+)
+
+const (
+	UpstreamStateEnabled  = "enabled"
+	UpstreamStateDisabled = "disabled"
+	UpstreamStateDraining = "draining"
+)
+
+var ErrNotAdmin = errors.New("client certificate is not allowed to use the admin API")
+var ErrNotReader = errors.New("client certificate is not allowed to list upstreams")
+var ErrInvalidState = errors.New("invalid upstream state")
+
+type UpstreamState struct {
+	Key               string `json:"key"`
+	State             string `json:"state"`
+	Available         bool   `json:"available"`
+	ActiveConnections int64  `json:"active_connections"`
+	// set once a draining upstream has no connections left
+	Drained bool `json:"drained"`
+}
+
+// SetUpstreamState enables, disables or drains an upstream. Disabled and
+// draining upstreams get no new connections, their existing ones are kept.
+func (ts *TrackerServer) SetUpstreamState(key string, state string) (*UpstreamState, error) {
+	var result *UpstreamState
+
+	err := ts.registry.update(key, func(upstream *Upstream) error {
+		switch state {
+		case UpstreamStateEnabled:
+			upstream.Enabled = true
+			upstream.Draining = false
+		case UpstreamStateDisabled:
+			upstream.Enabled = false
+			upstream.Draining = false
+		case UpstreamStateDraining:
+			upstream.Enabled = false
+			upstream.Draining = true
+		default:
+			return ErrInvalidState
+		}
+
+		log.Printf("upstream %s is now %s\n", upstream.Key, state)
+
+		result = upstream.state()
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if state == UpstreamStateEnabled {
+		ts.available.notify()
+	}
+
+	return result, nil
+}
+
+func (ts *TrackerServer) GetUpstreamState(key string) (*UpstreamState, error) {
+	var result *UpstreamState
+
+	ts.registry.view(func(upstreams map[string]*Upstream) {
+		if upstream, ok := upstreams[key]; ok {
+			result = upstream.state()
+		}
+	})
+
+	if result == nil {
+		return nil, ErrNoSuchUpstream
+	}
+
+	return result, nil
+}
+
+// adminOnly requires a certificate with the admin role whose subject is
+// listed in admins, so an empty list allows nobody
+func adminOnly(f func(TrackerContext) error) func(TrackerContext) error {
+	return func(c TrackerContext) error {
+		cert, err := peerCertificate(c)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, ApiError{err.Error()})
+		}
+
+		if !certificates.HasRole(cert, certificates.RoleAdmin) {
+			return c.JSON(http.StatusForbidden, ApiError{ErrNotAdmin.Error()})
+		}
+
+		if !slices.Contains(c.server.admins, cert.Subject.CommonName) {
+			return c.JSON(http.StatusForbidden, ApiError{ErrNotAdmin.Error()})
+		}
+
+		return f(c)
+	}
+}
+
+// readersOnly requires a certificate with the admin or server role. Upstreams
+// have no business knowing about each other.
+func readersOnly(f func(TrackerContext) error) func(TrackerContext) error {
+	return func(c TrackerContext) error {
+		cert, err := peerCertificate(c)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, ApiError{err.Error()})
+		}
+
+		if !certificates.HasRole(cert, certificates.RoleAdmin) && !certificates.HasRole(cert, certificates.RoleServer) {
+			return c.JSON(http.StatusForbidden, ApiError{ErrNotReader.Error()})
+		}
+
+		return f(c)
+	}
+}
+
+func getUpstreamState(c TrackerContext) error {
+	state, err := c.server.GetUpstreamState(c.Param("key"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, ApiError{err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, state)
+}
+
+func setUpstreamState(state string) func(TrackerContext) error {
+	return func(c TrackerContext) error {
+		identity, _ := peerIdentity(c)
+		log.Printf("%s requested upstream %s to be %s\n", identity, c.Param("key"), state)
+
+		upstreamState, err := c.server.SetUpstreamState(c.Param("key"), state)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, ApiError{err.Error()})
+		}
+
+		return c.JSON(http.StatusOK, upstreamState)
+	}
+}
+
+func addUpstream(c TrackerContext) error {
+	var upstreamConfig config.UpstreamConfig
+
+	err := c.Bind(&upstreamConfig)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ApiError{""})
+	}
+
+	identity, _ := peerIdentity(c)
+	log.Printf("%s requested upstream %s to be added\n", identity, upstreamConfig.Key)
+
+	state, err := c.server.AddUpstream(upstreamConfig)
+	switch {
+	case errors.Is(err, ErrInvalidUpstream):
+		return c.JSON(http.StatusBadRequest, ApiError{err.Error()})
+	case errors.Is(err, ErrUpstreamExists):
+		return c.JSON(http.StatusConflict, ApiError{err.Error()})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, ApiError{err.Error()})
+	}
+
+	return c.JSON(http.StatusCreated, state)
+}
+
+func removeUpstream(c TrackerContext) error {
+	identity, _ := peerIdentity(c)
+	log.Printf("%s requested upstream %s to be removed\n", identity, c.Param("key"))
+
+	err := c.server.RemoveUpstream(c.Param("key"))
+	switch {
+	case errors.Is(err, ErrNoSuchUpstream):
+		return c.JSON(http.StatusNotFound, ApiError{err.Error()})
+	case errors.Is(err, ErrStaticUpstream):
+		return c.JSON(http.StatusConflict, ApiError{err.Error()})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, ApiError{err.Error()})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,122 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/config"
+	"github.com/pkg/errors"
+)
+
+// AdminClient uses the tracker admin API with a certificate listed in the
+// server's admins
+type AdminClient struct {
+	serverURL  string
+	httpClient *http.Client
+}
+
+func NewAdminClient(serverURL string, serverName string, serverCA *x509.Certificate, cert *x509.Certificate, key *ecdsa.PrivateKey, revocation *certificates.RevocationChecker) *AdminClient {
+	return &AdminClient{
+		serverURL:  serverURL,
+		httpClient: newHTTPClient(serverName, serverCA, cert, key, nil, revocation),
+	}
+}
+
+// Upstreams returns every upstream as reported by /api/upstreams
+func (ac *AdminClient) Upstreams() (json.RawMessage, error) {
+	var upstreams json.RawMessage
+
+	err := ac.do(http.MethodGet, "/api/upstreams", nil, &upstreams)
+	return upstreams, err
+}
+
+func (ac *AdminClient) GetUpstreamState(key string) (*UpstreamState, error) {
+	var state UpstreamState
+
+	err := ac.do(http.MethodGet, "/api/upstreams/"+url.PathEscape(key), nil, &state)
+	return &state, err
+}
+
+func (ac *AdminClient) SetUpstreamState(key string, state string) (*UpstreamState, error) {
+	var result UpstreamState
+
+	actions := map[string]string{
+		UpstreamStateEnabled:  "enable",
+		UpstreamStateDisabled: "disable",
+		UpstreamStateDraining: "drain",
+	}
+
+	action, ok := actions[state]
+	if !ok {
+		return nil, ErrInvalidState
+	}
+
+	err := ac.do(http.MethodPost, "/api/upstreams/"+url.PathEscape(key)+"/"+action, nil, &result)
+	return &result, err
+}
+
+func (ac *AdminClient) AddUpstream(upstreamConfig config.UpstreamConfig) (*UpstreamState, error) {
+	var state UpstreamState
+
+	err := ac.do(http.MethodPost, "/api/upstreams", &upstreamConfig, &state)
+	return &state, err
+}
+
+func (ac *AdminClient) RemoveUpstream(key string) error {
+	return ac.do(http.MethodDelete, "/api/upstreams/"+url.PathEscape(key), nil, nil)
+}
+
+func (ac *AdminClient) do(method string, path string, request any, result any) error {
+	var body io.Reader
+
+	if request != nil {
+		encodedRequest, err := json.Marshal(request)
+		if err != nil {
+			return errors.Wrap(err, "could not encode request")
+		}
+
+		body = bytes.NewReader(encodedRequest)
+	}
+
+	httpRequest, err := http.NewRequest(method, ac.serverURL+path, body)
+	if err != nil {
+		return errors.Wrap(err, "could not create request")
+	}
+
+	if request != nil {
+		httpRequest.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := ac.httpClient.Do(httpRequest)
+	if err != nil {
+		return errors.Wrapf(err, "could not send %s %s request", method, path)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var apiError ApiError
+		json.NewDecoder(response.Body).Decode(&apiError)
+
+		return fmt.Errorf("%s %s response: %d %s", method, path, response.StatusCode, apiError.Error)
+	}
+
+	if result == nil {
+		io.Copy(io.Discard, response.Body)
+		return nil
+	}
+
+	err = json.NewDecoder(response.Body).Decode(result)
+	if err != nil {
+		return errors.Wrap(err, "could not decode response")
+	}
+
+	return nil
+}
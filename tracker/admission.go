@@ -0,0 +1,69 @@
+package tracker
+
+import (
+	"crypto/x509"
+	"errors"
+	"log"
+	"path/filepath"
+
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/config"
+)
+
+var ErrNotAdmitted = errors.New("certificate is not allowed to register as an upstream")
+
+// admitUpstream registers the upstream presenting cert if it is not known
+// yet and auto admission is enabled. The certificate was already verified
+// against our CA and CRL by the TLS handshake.
+func (ts *TrackerServer) admitUpstream(cert *x509.Certificate) error {
+	key := cert.Subject.CommonName
+
+	if _, ok := ts.registry.snapshot().upstreams[key]; ok {
+		return nil
+	}
+
+	if !ts.autoAdmit {
+		return ErrNoSuchUpstream
+	}
+
+	if !certificates.HasRole(cert, certificates.RoleUpstream) || !ts.autoAdmits(key) {
+		return ErrNotAdmitted
+	}
+
+	ts.keys.lock.Lock()
+	defer ts.keys.lock.Unlock()
+
+	err := ts.registry.add(ts.newAdmittedUpstream(key))
+	if errors.Is(err, ErrUpstreamExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("upstream %s admitted by its certificate, serial %s\n", key, cert.SerialNumber)
+
+	return nil
+}
+
+// autoAdmits tells whether auto admission lets key in
+func (ts *TrackerServer) autoAdmits(key string) bool {
+	if !ts.autoAdmit {
+		return false
+	}
+
+	if ts.autoAdmitPattern != "" {
+		if matched, _ := filepath.Match(ts.autoAdmitPattern, key); !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ts *TrackerServer) newAdmittedUpstream(key string) *Upstream {
+	upstream := ts.newUpstream(config.UpstreamConfig{Key: key})
+	upstream.AutoAdmitted = true
+
+	return upstream
+}
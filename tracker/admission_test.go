@@ -0,0 +1,76 @@
+package tracker
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/config"
+)
+
+func testCertificate(subject string, roles ...string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: subject, OrganizationalUnit: roles},
+	}
+}
+
+func TestAdmitUpstream(t *testing.T) {
+	cfg := testConfig(1, time.Minute)
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	if err := ts.admitUpstream(testCertificate("upstream-9", certificates.RoleUpstream)); !errors.Is(err, ErrNoSuchUpstream) {
+		t.Errorf("admitted an upstream with auto admission disabled: %v", err)
+	}
+
+	cfg.AutoAdmitUpstreams = true
+	cfg.AutoAdmitPattern = "upstream-*"
+	ts = newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	rejected := []*x509.Certificate{
+		testCertificate("upstream-8"),
+		testCertificate("upstream-8", "client"),
+		testCertificate("other", certificates.RoleUpstream),
+	}
+	for _, cert := range rejected {
+		if err := ts.admitUpstream(cert); !errors.Is(err, ErrNotAdmitted) {
+			t.Errorf("admitted %s with roles %v: %v", cert.Subject.CommonName, cert.Subject.OrganizationalUnit, err)
+		}
+	}
+
+	if err := ts.admitUpstream(testCertificate("upstream-9", certificates.RoleUpstream)); err != nil {
+		t.Fatal(err)
+	}
+
+	sendKeepalive(t, ts, "upstream-9", 41009)
+
+	upstream := ts.registry.snapshot().upstreams["upstream-9"]
+	if upstream == nil || !upstream.AutoAdmitted || !upstream.Available {
+		t.Fatalf("upstream not admitted: %+v", upstream)
+	}
+
+	// known upstreams are left alone, whatever their certificate
+	if err := ts.admitUpstream(testCertificate("upstream-0")); err != nil {
+		t.Error(err)
+	}
+
+	state, err := ts.AddUpstream(config.UpstreamConfig{Key: "upstream-9", Weight: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream = ts.registry.snapshot().upstreams["upstream-9"]
+	if upstream.AutoAdmitted || upstream.Weight != 3 || !state.Available {
+		t.Errorf("admitted upstream not taken over: %+v", upstream)
+	}
+
+	if err := ts.RemoveUpstream("upstream-9"); err != nil {
+		t.Fatal(err)
+	}
+
+	checkConsistency(t, ts)
+}
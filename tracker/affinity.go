@@ -0,0 +1,128 @@
+package tracker
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AffinityNone              = "none"
+	AffinityClient            = "client"
+	AffinityClientDestination = "client_destination"
+)
+
+const affinitySweepInterval = time.Minute
+
+// SelectionRequest describes who a connection is for, so the tracker can
+// honour affinity when picking an upstream
+type SelectionRequest struct {
+	ClientID    string
+	Destination string
+
+	// chosen by the client
+	Upstream string
+	Session  string
+	Tags     []string
+
+	// upstreams already tried for this connection
+	Exclude []string
+}
+
+type affinityPin struct {
+	upstream string
+	// unix nanoseconds, refreshed atomically on every use
+	expires int64
+}
+
+// Affinity pins clients to upstreams. New keys are placed with consistent
+// hashing over the available upstreams and remembered for ttl, so they
+// survive upstreams joining the set. Session tokens chosen by clients are
+// pinned regardless of the mode.
+type Affinity struct {
+	mode string
+	ttl  time.Duration
+
+	pins sync.Map
+}
+
+func NewAffinity(mode string, ttl time.Duration) (*Affinity, error) {
+	switch mode {
+	case "":
+		mode = AffinityNone
+	case AffinityNone, AffinityClient, AffinityClientDestination:
+	default:
+		return nil, fmt.Errorf("unknown affinity mode %q", mode)
+	}
+
+	return &Affinity{
+		mode: mode,
+		ttl:  ttl,
+	}, nil
+}
+
+func (a *Affinity) Key(request *SelectionRequest) string {
+	if request == nil {
+		return ""
+	}
+
+	// sessions are scoped to their client so they cannot collide
+	if request.Session != "" {
+		return request.ClientID + "|session|" + request.Session
+	}
+
+	if request.ClientID == "" {
+		return ""
+	}
+
+	switch a.mode {
+	case AffinityClient:
+		return request.ClientID
+	case AffinityClientDestination:
+		return request.ClientID + "|" + request.Destination
+	}
+
+	return ""
+}
+
+// get returns the upstream pinned to key in the snapshot, choosing one on
+// its ring if there is no valid pin. A pinned upstream the filter rejects,
+// because it is full or its breaker is open, is only skipped for this
+// connection: the pin stays until it expires or the upstream goes away.
+func (a *Affinity) get(s *snapshot, key string, filter UpstreamFilter) *Upstream {
+	now := time.Now()
+
+	if value, ok := a.pins.Load(key); ok {
+		pin := value.(*affinityPin)
+		upstream := s.upstreams[pin.upstream]
+
+		if upstream != nil && upstream.Available && now.UnixNano() < atomic.LoadInt64(&pin.expires) {
+			if !filter.Accepts(upstream) {
+				return s.ring.Get(key, filter)
+			}
+
+			atomic.StoreInt64(&pin.expires, now.Add(a.ttl).UnixNano())
+			return upstream
+		}
+	}
+
+	upstream := s.ring.Get(key, filter)
+	if upstream != nil && a.ttl > 0 {
+		a.pins.Store(key, &affinityPin{
+			upstream: upstream.Key,
+			expires:  now.Add(a.ttl).UnixNano(),
+		})
+	}
+
+	return upstream
+}
+
+func (a *Affinity) sweep(now time.Time) {
+	a.pins.Range(func(key, value any) bool {
+		if now.UnixNano() >= atomic.LoadInt64(&value.(*affinityPin).expires) {
+			a.pins.Delete(key)
+		}
+		return true
+	})
+}
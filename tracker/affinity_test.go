@@ -0,0 +1,197 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHashRingRemapping(t *testing.T) {
+	const keys = 2000
+
+	upstreams := testUpstreams(11)
+
+	assign := func(upstreams []*Upstream) map[string]string {
+		ring := NewHashRing(upstreams)
+		assigned := make(map[string]string, keys)
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("client-%d", i)
+			assigned[key] = ring.Get(key, nil).Key
+		}
+		return assigned
+	}
+
+	before := assign(upstreams[:10])
+	joined := assign(upstreams)
+	left := assign(upstreams[1:10])
+
+	moved := 0
+	for key, upstream := range joined {
+		if upstream == before[key] {
+			continue
+		}
+		moved++
+
+		// keys only move to the new upstream
+		if upstream != upstreams[10].Key {
+			t.Fatalf("%s moved from %s to %s", key, before[key], upstream)
+		}
+	}
+
+	// about one key in eleven should move
+	if moved == 0 || moved > keys/5 {
+		t.Errorf("%d of %d keys moved when an upstream joined", moved, keys)
+	}
+
+	for key, upstream := range left {
+		if upstream != before[key] && before[key] != upstreams[0].Key {
+			t.Errorf("%s moved from %s to %s, its upstream did not leave", key, before[key], upstream)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, upstream := range before {
+		counts[upstream]++
+	}
+	for _, u := range upstreams[:10] {
+		if counts[u.Key] < keys/30 {
+			t.Errorf("%s only got %d of %d keys", u.Key, counts[u.Key], keys)
+		}
+	}
+}
+
+// affinityClient returns a client the ring places on want once every given
+// upstream is available
+func affinityClient(t *testing.T, upstreams []*Upstream, want string) string {
+	t.Helper()
+
+	ring := NewHashRing(upstreams)
+	for i := 0; i < 1000; i++ {
+		client := fmt.Sprintf("client-%d", i)
+		if ring.Get(client, nil).Key == want {
+			return client
+		}
+	}
+
+	t.Fatalf("no client maps to %s", want)
+	return ""
+}
+
+func getFor(t *testing.T, ts *TrackerServer, client string) *Upstream {
+	t.Helper()
+
+	upstream, err := ts.GetUpstream(context.Background(), &SelectionRequest{ClientID: client, Destination: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return upstream
+}
+
+func TestAffinitySticksThroughBusyUpstreams(t *testing.T) {
+	cfg := testConfig(3, time.Minute)
+	cfg.Upstreams[0].MaxConnections = 1
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityClient)
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	client := affinityClient(t, testUpstreams(3), "upstream-1")
+
+	// pinned to the only upstream available at first
+	held := getFor(t, ts, client)
+	if held.Key != "upstream-0" {
+		t.Fatalf("pinned to %s", held.Key)
+	}
+
+	sendKeepalive(t, ts, "upstream-1", 41001)
+	sendKeepalive(t, ts, "upstream-2", 41002)
+
+	// upstream-0 is full while the first connection is open
+	busy := getFor(t, ts, client)
+	if busy.Key == "upstream-0" {
+		t.Fatal("selected a full upstream")
+	}
+	busy.ConnectionClosed()
+	held.ConnectionClosed()
+
+	for i := 0; i < 5; i++ {
+		upstream := getFor(t, ts, client)
+		if upstream.Key != "upstream-0" {
+			t.Fatalf("client moved to %s after its upstream was busy", upstream.Key)
+		}
+		upstream.ConnectionClosed()
+	}
+
+	// a retry excluding the pinned upstream does not move the client either
+	upstream, err := ts.GetUpstream(context.Background(), &SelectionRequest{ClientID: client, Exclude: []string{"upstream-0"}})
+	if err != nil || upstream.Key == "upstream-0" {
+		t.Fatalf("got %v: %v", upstream, err)
+	}
+	upstream.ConnectionClosed()
+
+	if upstream := getFor(t, ts, client); upstream.Key != "upstream-0" {
+		t.Errorf("client moved to %s after a retry", upstream.Key)
+	}
+}
+
+func TestAffinityExpires(t *testing.T) {
+	cfg := testConfig(2, time.Minute)
+	cfg.AffinityTTL = 50 * time.Millisecond
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityClient)
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	client := affinityClient(t, testUpstreams(2), "upstream-1")
+
+	upstream := getFor(t, ts, client)
+	upstream.ConnectionClosed()
+
+	// the pin survives upstream-1 joining, where the ring now puts the client
+	sendKeepalive(t, ts, "upstream-1", 41001)
+
+	if upstream := getFor(t, ts, client); upstream.Key != "upstream-0" {
+		t.Fatalf("client moved to %s while pinned", upstream.Key)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if upstream := getFor(t, ts, client); upstream.Key != "upstream-1" {
+		t.Errorf("pin to %s did not expire", upstream.Key)
+	}
+}
+
+func TestAffinityFollowsUpstreamsLeaving(t *testing.T) {
+	cfg := testConfig(2, time.Minute)
+	cfg.ProbeInterval = time.Second
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityClient)
+	for _, key := range []string{"upstream-0", "upstream-1"} {
+		sendKeepalive(t, ts, key, 41000)
+		ts.ReportProbe(key, nil)
+	}
+
+	client := affinityClient(t, testUpstreams(2), "upstream-1")
+
+	upstream := getFor(t, ts, client)
+	if upstream.Key != "upstream-1" {
+		t.Fatalf("pinned to %s", upstream.Key)
+	}
+	upstream.ConnectionClosed()
+
+	ts.ReportProbe("upstream-1", errors.New("probe failed"))
+
+	upstream = getFor(t, ts, client)
+	if upstream.Key != "upstream-0" {
+		t.Fatalf("client still pinned to %s after it left", upstream.Key)
+	}
+	upstream.ConnectionClosed()
+
+	// the client is pinned to its new upstream now
+	ts.ReportProbe("upstream-1", nil)
+
+	if upstream := getFor(t, ts, client); upstream.Key != "upstream-0" {
+		t.Errorf("client moved back to %s", upstream.Key)
+	}
+}
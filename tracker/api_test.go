@@ -0,0 +1,301 @@
+package tracker
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ca0s/despiste/certificates"
+)
+
+func testAuthority(tb testing.TB) (*x509.Certificate, *ecdsa.PrivateKey) {
+	tb.Helper()
+
+	now := time.Now()
+
+	block, keyBlock, err := certificates.GenerateCert(certificates.RoleCA, nil, nil, 1, "ca", now, now.Add(time.Hour))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ca, _ := x509.ParseCertificate(block.Bytes)
+	key, _ := x509.ParseECPrivateKey(keyBlock.Bytes)
+
+	return ca, key
+}
+
+func testCRL(tb testing.TB, ca *x509.Certificate, caKey *ecdsa.PrivateKey, number int64, serials ...int64) []byte {
+	tb.Helper()
+
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              big.NewInt(number),
+		RevokedCertificates: revoked,
+		ThisUpdate:          time.Now(),
+		NextUpdate:          time.Now().Add(time.Hour),
+	}, ca, caKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return crl
+}
+
+// apiRequest calls the tracker API as the peer presenting cert, or as one
+// without a certificate if cert is nil
+func apiRequest(ts *TrackerServer, cert *x509.Certificate, method string, path string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.RemoteAddr = "127.0.0.1:40000"
+
+	if cert != nil {
+		request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+
+	recorder := httptest.NewRecorder()
+	ts.router().ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestCRLDistribution(t *testing.T) {
+	ca, caKey := testAuthority(t)
+
+	cfg := testConfig(1, time.Minute)
+	cfg.Revocation = certificates.NewRevocationChecker(ca)
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	server := httptest.NewServer(ts.router())
+	defer server.Close()
+
+	client := &TrackerClient{
+		httpClient: server.Client(),
+		crlURL:     server.URL + "/api/crl",
+		revocation: certificates.NewRevocationChecker(ca),
+	}
+
+	if recorder := apiRequest(ts, nil, http.MethodGet, "/api/crl", ""); recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d without a CRL", recorder.Code)
+	}
+	if err := client.FetchCRL(); err != nil || client.revocation.Raw() != nil {
+		t.Errorf("fetched a CRL the tracker does not have: %v", err)
+	}
+
+	crl := testCRL(t, ca, caKey, 2, 5)
+	if _, err := cfg.Revocation.Update(crl); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := server.Client().Get(server.URL + "/api/crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || string(served) != string(crl) {
+		t.Errorf("tracker serves %d bytes with status %d", len(served), response.StatusCode)
+	}
+
+	if err := client.FetchCRL(); err != nil || !client.revocation.IsRevoked(big.NewInt(5)) {
+		t.Fatalf("fetched CRL not enforced: %v", err)
+	}
+
+	// a client already enforcing a newer CRL keeps it
+	client.revocation.Update(testCRL(t, ca, caKey, 3, 6))
+
+	if err := client.FetchCRL(); !errors.Is(err, certificates.ErrStaleCRL) || !client.revocation.IsRevoked(big.NewInt(6)) {
+		t.Errorf("stale CRL from the tracker replaced a newer one: %v", err)
+	}
+}
+
+func TestKeepAliveAuthentication(t *testing.T) {
+	ts := newTestServer(t, testConfig(2, time.Minute), SelectorRoundRobin, AffinityNone)
+
+	upstream := testCertificate("upstream-0", certificates.RoleUpstream)
+	keepalive := func(key string) string {
+		return `{"client_key": "` + key + `", "address": "127.0.0.1:41000"}`
+	}
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		body   string
+		status int
+	}{
+		{"no certificate", nil, keepalive("upstream-0"), http.StatusUnauthorized},
+		{"another upstream's key", upstream, keepalive("upstream-1"), http.StatusForbidden},
+		{"admin certificate", testCertificate("upstream-1", certificates.RoleAdmin), keepalive("upstream-1"), http.StatusForbidden},
+		{"client certificate", testCertificate("upstream-1", certificates.RoleClient), keepalive("upstream-1"), http.StatusForbidden},
+		{"own key", upstream, keepalive("upstream-0"), http.StatusOK},
+		{"no key", upstream, keepalive(""), http.StatusOK},
+	}
+
+	for _, test := range tests {
+		if recorder := apiRequest(ts, test.cert, http.MethodPost, "/api/keepalive", test.body); recorder.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, recorder.Code, test.status)
+		}
+	}
+
+	snapshot := ts.registry.snapshot()
+	if !snapshot.upstreams["upstream-0"].Available || snapshot.upstreams["upstream-1"].Available {
+		t.Error("rejected keepalives changed the registry")
+	}
+}
+
+func TestAdminUpstreamState(t *testing.T) {
+	cfg := testConfig(2, time.Minute)
+	cfg.Admins = []string{"ops"}
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	sendKeepalive(t, ts, "upstream-0", 41000)
+	sendKeepalive(t, ts, "upstream-1", 41001)
+
+	admin := testCertificate("ops", certificates.RoleAdmin)
+
+	setState := func(cert *x509.Certificate, key string, action string) (int, UpstreamState) {
+		t.Helper()
+
+		var result UpstreamState
+		recorder := apiRequest(ts, cert, http.MethodPost, "/api/upstreams/"+key+"/"+action, "")
+		json.Unmarshal(recorder.Body.Bytes(), &result)
+
+		return recorder.Code, result
+	}
+
+	getState := func(key string) UpstreamState {
+		t.Helper()
+
+		var result UpstreamState
+		recorder := apiRequest(ts, admin, http.MethodGet, "/api/upstreams/"+key, "")
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || recorder.Code != http.StatusOK {
+			t.Fatalf("got status %d: %v", recorder.Code, err)
+		}
+
+		return result
+	}
+
+	rejected := []struct {
+		name   string
+		cert   *x509.Certificate
+		status int
+	}{
+		{"no certificate", nil, http.StatusUnauthorized},
+		{"upstream certificate", testCertificate("ops", certificates.RoleUpstream), http.StatusForbidden},
+		{"client certificate", testCertificate("ops", certificates.RoleClient), http.StatusForbidden},
+		{"unlisted admin", testCertificate("intruder", certificates.RoleAdmin), http.StatusForbidden},
+	}
+
+	for _, test := range rejected {
+		if status, _ := setState(test.cert, "upstream-0", "disable"); status != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, status, test.status)
+		}
+	}
+
+	if state := getState("upstream-0"); state.State != UpstreamStateEnabled {
+		t.Fatalf("rejected requests changed the state to %s", state.State)
+	}
+
+	var connections []*Upstream
+	for i := 0; i < 2; i++ {
+		upstream, err := ts.GetUpstream(context.Background(), &SelectionRequest{Upstream: "upstream-0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		connections = append(connections, upstream)
+	}
+
+	status, state := setState(admin, "upstream-0", "drain")
+	if status != http.StatusOK || state.State != UpstreamStateDraining || state.ActiveConnections != 2 || state.Drained {
+		t.Fatalf("got status %d and state %+v", status, state)
+	}
+
+	connections[0].ConnectionClosed()
+	if state := getState("upstream-0"); state.ActiveConnections != 1 || state.Drained {
+		t.Errorf("got state %+v with one connection left", state)
+	}
+
+	connections[1].ConnectionClosed()
+	if state := getState("upstream-0"); state.ActiveConnections != 0 || !state.Drained {
+		t.Errorf("got state %+v with no connections left", state)
+	}
+
+	if status, _ := setState(admin, "upstream-1", "disable"); status != http.StatusOK {
+		t.Fatalf("got status %d disabling upstream-1", status)
+	}
+
+	// keepalives refresh the upstreams but leave the admin state alone
+	sendKeepalive(t, ts, "upstream-0", 41000)
+	sendKeepalive(t, ts, "upstream-1", 41001)
+
+	if state := getState("upstream-0"); state.State != UpstreamStateDraining || !state.Available {
+		t.Errorf("got state %+v after a keepalive", state)
+	}
+	if state := getState("upstream-1"); state.State != UpstreamStateDisabled || !state.Available {
+		t.Errorf("got state %+v after a keepalive", state)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if upstream, err := ts.GetUpstream(ctx, &SelectionRequest{}); err == nil {
+		t.Errorf("picked %s while every upstream is disabled or draining", upstream.Key)
+	}
+
+	if status, state := setState(admin, "upstream-0", "enable"); status != http.StatusOK || state.State != UpstreamStateEnabled {
+		t.Fatalf("got status %d and state %+v", status, state)
+	}
+
+	upstream, err := ts.GetUpstream(context.Background(), &SelectionRequest{})
+	if err != nil || upstream.Key != "upstream-0" {
+		t.Errorf("got %v after enabling upstream-0: %v", upstream, err)
+	}
+}
+
+func TestUpstreamsReadAccess(t *testing.T) {
+	ts := newTestServer(t, testConfig(1, time.Minute), SelectorRoundRobin, AffinityNone)
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		status int
+	}{
+		{"no certificate", nil, http.StatusUnauthorized},
+		{"upstream certificate", testCertificate("upstream-0", certificates.RoleUpstream), http.StatusForbidden},
+		{"client certificate", testCertificate("client", certificates.RoleClient), http.StatusForbidden},
+		{"server certificate", testCertificate("server", certificates.RoleServer), http.StatusOK},
+		// reading does not need to be listed in admins
+		{"admin certificate", testCertificate("ops", certificates.RoleAdmin), http.StatusOK},
+	}
+
+	for _, test := range tests {
+		for _, path := range []string{"/api/upstreams", "/api/upstreams/upstream-0"} {
+			recorder := apiRequest(ts, test.cert, http.MethodGet, path, "")
+			if recorder.Code != test.status {
+				t.Errorf("%s reading %s: got status %d, want %d", test.name, path, recorder.Code, test.status)
+			}
+
+			if test.status != http.StatusOK && strings.Contains(recorder.Body.String(), "127.0.0.1:41000") {
+				t.Errorf("%s reading %s: got the upstream address", test.name, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package tracker
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+type BreakerConfig struct {
+	// consecutive dial failures that trip the breaker, 0 disables it
+	Threshold  int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// called whenever the upstream may be tried again
+	OnReady func()
+}
+
+type BreakerStatus struct {
+	State               string
+	ConsecutiveFailures int
+	OpenUntil           *time.Time `json:",omitempty"`
+}
+
+// CircuitBreaker ejects an upstream from selection after consecutive dial
+// failures. Once the backoff elapses a single trial connection is let
+// through: success closes the breaker, failure opens it again for twice as
+// long. A nil breaker is always closed.
+type CircuitBreaker struct {
+	key    string
+	config BreakerConfig
+
+	// set while not closed, lets selections skip the lock in the common case
+	tripped atomic.Bool
+
+	lock      sync.Mutex
+	state     string
+	failures  int
+	backoff   time.Duration
+	openUntil time.Time
+	trial     bool
+}
+
+func NewCircuitBreaker(key string, config BreakerConfig) *CircuitBreaker {
+	if config.Threshold <= 0 {
+		return nil
+	}
+
+	return &CircuitBreaker{
+		key:    key,
+		config: config,
+		state:  BreakerClosed,
+	}
+}
+
+// Selectable reports whether the upstream may be picked, without claiming
+// the half-open trial
+func (b *CircuitBreaker) Selectable() bool {
+	if b == nil || !b.tripped.Load() {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return !time.Now().Before(b.openUntil)
+	case BreakerHalfOpen:
+		return !b.trial
+	}
+
+	return true
+}
+
+// Admit claims a connection slot, which is only refused while open or while
+// the half-open trial is in flight
+func (b *CircuitBreaker) Admit() bool {
+	if b == nil || !b.tripped.Load() {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+
+		b.setState(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if b.trial {
+			return false
+		}
+
+		b.trial = true
+	}
+
+	return true
+}
+
+func (b *CircuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures = 0
+	b.trial = false
+	b.backoff = 0
+
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed)
+	}
+}
+
+func (b *CircuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	b.trial = false
+
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.config.Threshold) {
+		b.open()
+	}
+}
+
+// Abort releases the half-open trial without a verdict, for dials cancelled
+// by the client
+func (b *CircuitBreaker) Abort() {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.trial = false
+	b.ready()
+}
+
+func (b *CircuitBreaker) Status() BreakerStatus {
+	if b == nil {
+		return BreakerStatus{State: BreakerClosed}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	status := BreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+	}
+
+	if b.state == BreakerOpen {
+		openUntil := b.openUntil
+		status.OpenUntil = &openUntil
+	}
+
+	return status
+}
+
+func (b *CircuitBreaker) open() {
+	if b.backoff == 0 {
+		b.backoff = b.config.Backoff
+	} else {
+		b.backoff *= 2
+	}
+
+	if b.config.MaxBackoff > 0 && b.backoff > b.config.MaxBackoff {
+		b.backoff = b.config.MaxBackoff
+	}
+
+	b.openUntil = time.Now().Add(b.backoff)
+	b.setState(BreakerOpen)
+
+	time.AfterFunc(b.backoff, b.ready)
+}
+
+func (b *CircuitBreaker) ready() {
+	if b.config.OnReady != nil {
+		b.config.OnReady()
+	}
+}
+
+func (b *CircuitBreaker) setState(state string) {
+	b.state = state
+	b.tripped.Store(state != BreakerClosed)
+
+	switch state {
+	case BreakerOpen:
+		log.Printf("upstream %s breaker open after %d consecutive failures, retrying in %s\n", b.key, b.failures, b.backoff)
+	case BreakerHalfOpen:
+		log.Printf("upstream %s breaker half-open, sending a trial connection\n", b.key)
+	case BreakerClosed:
+		log.Printf("upstream %s breaker closed\n", b.key)
+	}
+}
@@ -0,0 +1,47 @@
+package tracker
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// broadcaster wakes up everyone waiting on it each time notify is called
+type broadcaster struct {
+	lock sync.Mutex
+	// nil while nobody waits, so notify is a single load on the hot path
+	ch atomic.Pointer[chan struct{}]
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{}
+}
+
+// wait returns a channel closed on the next notify. Take it before checking
+// the condition waited on, or a notify in between is missed.
+func (b *broadcaster) wait() <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ch := b.ch.Load()
+	if ch == nil {
+		c := make(chan struct{})
+		ch = &c
+		b.ch.Store(ch)
+	}
+
+	return *ch
+}
+
+func (b *broadcaster) notify() {
+	if b == nil || b.ch.Load() == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if ch := b.ch.Load(); ch != nil {
+		close(*ch)
+		b.ch.Store(nil)
+	}
+}
@@ -2,6 +2,7 @@ package tracker
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -12,6 +13,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/ca0s/despiste/certificates"
 	"github.com/pkg/errors"
 )
 
@@ -20,33 +22,32 @@ type TrackerClient struct {
 	keepAlive     time.Duration
 	clientKey     string
 	clientAddress string
+	tags          []string
+	load          LoadSource
 
 	httpClient *http.Client
+	revocation *certificates.RevocationChecker
 
 	keepAliveURL string
+	crlURL       string
 }
 
-func NewTrackerClient(clientKey string, serverURL string, clientAddress string, keepAlive time.Duration, serverName string, serverCA *x509.Certificate) *TrackerClient {
-	certPool := x509.NewCertPool()
-	certPool.AddCert(serverCA)
+func NewTrackerClient(clientKey string, serverURL string, clientAddress string, tags []string, load LoadSource, keepAlive time.Duration, serverName string, serverCA *x509.Certificate, cert *x509.Certificate, key *ecdsa.PrivateKey, chain []*x509.Certificate, revocation *certificates.RevocationChecker) *TrackerClient {
+	httpClient := newHTTPClient(serverName, serverCA, cert, key, chain, revocation)
 
-	httpClient := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs:    certPool,
-				ServerName: serverName,
-			},
-		},
-	}
 	return &TrackerClient{
 		serverURL:     serverURL,
 		keepAlive:     keepAlive,
 		clientKey:     clientKey,
 		clientAddress: clientAddress,
+		tags:          tags,
+		load:          load,
 
 		httpClient: httpClient,
+		revocation: revocation,
 
 		keepAliveURL: fmt.Sprintf("%s/api/keepalive", serverURL),
+		crlURL:       fmt.Sprintf("%s/api/crl", serverURL),
 	}
 }
 
@@ -57,6 +58,13 @@ func (tc *TrackerClient) Run() {
 			log.Printf("error sending keepalive: %s\n", err)
 		}
 
+		if tc.revocation != nil {
+			err = tc.FetchCRL()
+			if err != nil {
+				log.Printf("error fetching CRL: %s\n", err)
+			}
+		}
+
 		time.Sleep(tc.keepAlive)
 	}
 }
@@ -65,6 +73,12 @@ func (tc *TrackerClient) SendKeepAlive() error {
 	request := KeepAliveRequest{
 		ClientKey: tc.clientKey,
 		Address:   tc.clientAddress,
+		Tags:      tc.tags,
+	}
+
+	if tc.load != nil {
+		load := tc.load.Load()
+		request.Load = &load
 	}
 
 	encodedRequest, err := json.Marshal(&request)
@@ -94,3 +108,60 @@ func (tc *TrackerClient) SendKeepAlive() error {
 
 	return nil
 }
+
+func (tc *TrackerClient) FetchCRL() error {
+	response, err := tc.httpClient.Get(tc.crlURL)
+	if err != nil {
+		return errors.Wrap(err, "could not send CRL request")
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		// the tracker has no CRL yet
+		io.Copy(io.Discard, response.Body)
+		return nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, response.Body)
+		return fmt.Errorf("CRL response: %d", response.StatusCode)
+	}
+
+	crl, err := io.ReadAll(response.Body)
+	if err != nil {
+		return errors.Wrap(err, "could not read CRL")
+	}
+
+	_, err = tc.revocation.Update(crl)
+	return err
+}
+
+// newHTTPClient returns a client authenticating to the tracker with cert, and
+// only accepting a tracker with a server certificate
+func newHTTPClient(serverName string, serverCA *x509.Certificate, cert *x509.Certificate, key *ecdsa.PrivateKey, chain []*x509.Certificate, revocation *certificates.RevocationChecker) *http.Client {
+	certPool := x509.NewCertPool()
+	certPool.AddCert(serverCA)
+
+	var tlsCert tls.Certificate
+	tlsCert.Certificate = append(tlsCert.Certificate, cert.Raw)
+	for _, intermediate := range chain {
+		tlsCert.Certificate = append(tlsCert.Certificate, intermediate.Raw)
+	}
+	tlsCert.PrivateKey = key
+
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		RootCAs:      certPool,
+		ServerName:   serverName,
+		Certificates: []tls.Certificate{tlsCert},
+
+		VerifyPeerCertificate: certificates.VerifyPeer(revocation, certificates.RoleServer),
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+		},
+	}
+}
@@ -0,0 +1,232 @@
+package tracker
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/config"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/pkg/errors"
+)
+
+var ErrEnrollmentDisabled = errors.New("enrollment is not enabled")
+var ErrTokenUsed = errors.New("enrollment token was already used")
+var ErrInvalidCSR = errors.New("invalid certificate request")
+
+// enrollment issues upstream certificates with the signer, an intermediate
+// that can only create upstreams, so the server never holds the CA key
+type enrollment struct {
+	address  string
+	ca       *x509.Certificate
+	signer   *x509.Certificate
+	key      *ecdsa.PrivateKey
+	validity time.Duration
+	ledger   *tokenLedger
+}
+
+// tokenLedger remembers the tokens already used until they expire
+type tokenLedger struct {
+	lock sync.Mutex
+	path string
+	used map[string]time.Time
+}
+
+func newEnrollment(cfg *config.Config) (*enrollment, error) {
+	ledger, err := loadTokenLedger(cfg.EnrollmentLedger)
+	if err != nil {
+		return nil, err
+	}
+
+	return &enrollment{
+		address:  cfg.EnrollmentAddress,
+		ca:       cfg.CACert,
+		signer:   cfg.SignerCert,
+		key:      cfg.SignerKey,
+		validity: cfg.EnrollmentValidity,
+		ledger:   ledger,
+	}, nil
+}
+
+func loadTokenLedger(path string) (*tokenLedger, error) {
+	ledger := &tokenLedger{
+		path: path,
+		used: make(map[string]time.Time),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ledger, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read enrollment ledger at %s", path)
+	}
+
+	err = json.Unmarshal(data, &ledger.used)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse enrollment ledger at %s", path)
+	}
+
+	return ledger, nil
+}
+
+// use records token as used. It is saved before returning, so a token can
+// not be used twice even if the server restarts right after.
+func (l *tokenLedger) use(token *certificates.EnrollmentToken) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.used[token.ID]; ok {
+		return ErrTokenUsed
+	}
+
+	used := make(map[string]time.Time, len(l.used)+1)
+	now := time.Now()
+
+	// expired tokens are rejected anyway, no need to keep them
+	for id, expires := range l.used {
+		if expires.After(now) {
+			used[id] = expires
+		}
+	}
+	used[token.ID] = token.Expires
+
+	data, err := json.MarshalIndent(used, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "could not encode enrollment ledger")
+	}
+
+	err = writeFileAtomic(l.path, data)
+	if err != nil {
+		return err
+	}
+
+	l.used = used
+
+	return nil
+}
+
+// Enroll issues an upstream certificate for the key in the PEM encoded csr,
+// named after the subject of token, and registers the upstream. It returns
+// the certificate followed by the signer's.
+func (ts *TrackerServer) Enroll(token string, csr string) ([]byte, error) {
+	if ts.enrollment == nil {
+		return nil, ErrEnrollmentDisabled
+	}
+
+	e := ts.enrollment
+
+	parsedToken, err := certificates.ParseEnrollmentToken(token, e.ca)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(csr))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, ErrInvalidCSR
+	}
+
+	request, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCSR, err)
+	}
+
+	serialNumber, err := certificates.RandomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notBefore := time.Now()
+	notAfter := notBefore.Add(e.validity)
+	if notAfter.After(e.signer.NotAfter) {
+		notAfter = e.signer.NotAfter
+	}
+
+	cert, err := certificates.SignCSR(
+		request, certificates.RoleUpstream,
+		e.signer, e.key,
+		serialNumber, parsedToken.Subject,
+		notBefore, notAfter,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCSR, err)
+	}
+
+	err = e.ledger.use(parsedToken)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("upstream %s enrolled with token %s, serial %d\n", parsedToken.Subject, parsedToken.ID, serialNumber)
+
+	if _, ok := ts.registry.snapshot().upstreams[parsedToken.Subject]; !ok {
+		_, err = ts.AddUpstream(config.UpstreamConfig{Key: parsedToken.Subject})
+		if err != nil && !errors.Is(err, ErrUpstreamExists) {
+			log.Printf("could not add enrolled upstream %s: %s\n", parsedToken.Subject, err)
+		}
+	}
+
+	result := pem.EncodeToMemory(cert)
+	result = append(result, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: e.signer.Raw})...)
+
+	return result, nil
+}
+
+// RunEnrollment serves the enrollment endpoint. New upstreams have no
+// certificate yet, so it is kept apart from the tracker API and does not ask
+// for one.
+func (ts *TrackerServer) RunEnrollment() error {
+	if ts.enrollment == nil {
+		return ErrEnrollmentDisabled
+	}
+
+	e := echo.New()
+	e.HideBanner = true
+	e.HidePort = true
+	e.Use(middleware.Recover())
+	e.Use(ContextMiddleware(ts))
+
+	e.POST("/api/enroll", withContext(enroll))
+
+	tlsConfig := ts.tlsConfig.Clone()
+	tlsConfig.ClientAuth = tls.NoClientCert
+	tlsConfig.VerifyPeerCertificate = nil
+
+	e.TLSServer.Addr = ts.enrollment.address
+	e.TLSServer.TLSConfig = tlsConfig
+
+	return e.StartServer(e.TLSServer)
+}
+
+func enroll(c TrackerContext) error {
+	var request EnrollmentRequest
+
+	err := c.Bind(&request)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, ApiError{""})
+	}
+
+	cert, err := c.server.Enroll(request.Token, request.CSR)
+	switch {
+	case errors.Is(err, certificates.ErrInvalidToken), errors.Is(err, certificates.ErrTokenExpired), errors.Is(err, ErrTokenUsed):
+		log.Printf("rejecting enrollment from %s: %s\n", c.RealIP(), err)
+		return c.JSON(http.StatusForbidden, ApiError{err.Error()})
+	case errors.Is(err, ErrInvalidCSR):
+		return c.JSON(http.StatusBadRequest, ApiError{err.Error()})
+	case err != nil:
+		log.Printf("could not enroll upstream: %s\n", err)
+		return c.JSON(http.StatusInternalServerError, ApiError{"could not issue certificate"})
+	}
+
+	return c.JSON(http.StatusOK, EnrollmentResponse{Certificate: string(cert)})
+}
@@ -0,0 +1,108 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+
+	"github.com/ca0s/despiste/certificates"
+	"github.com/pkg/errors"
+)
+
+// EnrollUpstream creates a new key and exchanges token for a certificate for
+// it at the tracker enrollment endpoint. It returns the certificate, its key
+// and the signer certificate, in the order they are written to the cert file.
+func EnrollUpstream(serverURL string, serverName string, serverCA *x509.Certificate, token string) (*pem.Block, *pem.Block, []*pem.Block, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to generate private key")
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "could not create certificate request")
+	}
+
+	encodedRequest, err := json.Marshal(EnrollmentRequest{
+		Token: token,
+		CSR:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})),
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	certPool := x509.NewCertPool()
+	certPool.AddCert(serverCA)
+
+	// we have no certificate to present yet
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS13,
+				RootCAs:    certPool,
+				ServerName: serverName,
+
+				VerifyPeerCertificate: certificates.VerifyPeer(nil, certificates.RoleServer),
+			},
+		},
+	}
+
+	response, err := httpClient.Post(fmt.Sprintf("%s/api/enroll", serverURL), "application/json", bytes.NewReader(encodedRequest))
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "could not contact the enrollment server")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var apiError ApiError
+		json.NewDecoder(response.Body).Decode(&apiError)
+		return nil, nil, nil, fmt.Errorf("enrollment failed with status %d: %s", response.StatusCode, apiError.Error)
+	}
+
+	var enrollmentResponse EnrollmentResponse
+
+	err = json.NewDecoder(response.Body).Decode(&enrollmentResponse)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "could not decode enrollment response")
+	}
+
+	var blocks []*pem.Block
+
+	data := []byte(enrollmentResponse.Certificate)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	if len(blocks) == 0 {
+		return nil, nil, nil, errors.New("enrollment response has no certificate")
+	}
+
+	cert, err := x509.ParseCertificate(blocks[0].Bytes)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "could not parse issued certificate")
+	}
+
+	if !key.PublicKey.Equal(cert.PublicKey) {
+		return nil, nil, nil, errors.New("issued certificate is not for our key")
+	}
+
+	encodedKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "failed to marshal ecdsa")
+	}
+
+	return blocks[0], &pem.Block{Type: "ECDSA PRIVATE KEY", Bytes: encodedKey}, blocks[1:], nil
+}
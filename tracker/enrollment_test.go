@@ -0,0 +1,111 @@
+package tracker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ca0s/despiste/certificates"
+)
+
+func TestEnroll(t *testing.T) {
+	now := time.Now()
+
+	caBlock, caKeyBlock, err := certificates.GenerateCert(certificates.RoleCA, nil, nil, 1, "ca", now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caBlock.Bytes)
+	caKey, _ := x509.ParseECPrivateKey(caKeyBlock.Bytes)
+
+	signerBlock, signerKeyBlock, err := certificates.GenerateCert(certificates.RoleSigner, ca, caKey, 2, "signer", now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(1, time.Minute)
+	cfg.CACert = ca
+	cfg.SignerCert, _ = x509.ParseCertificate(signerBlock.Bytes)
+	cfg.SignerKey, _ = x509.ParseECPrivateKey(signerKeyBlock.Bytes)
+	cfg.EnrollmentLedger = filepath.Join(t.TempDir(), "ledger.json")
+	cfg.EnrollmentValidity = 24 * time.Hour
+	cfg.UpstreamKeysFile = filepath.Join(t.TempDir(), "upstreams.json")
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	csr := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+
+	token, err := certificates.CreateEnrollmentToken("upstream-9", time.Hour, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bad request does not use up the token
+	if _, err := ts.Enroll(token, "garbage"); !errors.Is(err, ErrInvalidCSR) {
+		t.Errorf("enrolled with an invalid CSR: %v", err)
+	}
+
+	issued, err := ts.Enroll(token, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, rest := pem.Decode(issued)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ = pem.Decode(rest)
+	if block == nil || string(block.Bytes) != string(cfg.SignerCert.Raw) {
+		t.Error("signer certificate not returned")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(cfg.SignerCert)
+
+	chains, err := cert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := certificates.VerifyPeer(nil, certificates.RoleUpstream)(nil, chains); err != nil {
+		t.Error(err)
+	}
+
+	if cert.Subject.CommonName != "upstream-9" || !key.PublicKey.Equal(cert.PublicKey) || cert.NotAfter.After(cfg.SignerCert.NotAfter) {
+		t.Errorf("unexpected certificate %s until %s", cert.Subject, cert.NotAfter)
+	}
+
+	if _, ok := ts.registry.snapshot().upstreams["upstream-9"]; !ok {
+		t.Error("enrolled upstream not added")
+	}
+
+	if _, err := ts.Enroll(token, csr); !errors.Is(err, ErrTokenUsed) {
+		t.Errorf("token used twice: %v", err)
+	}
+
+	// used tokens and enrolled upstreams are remembered across restarts
+	ts = newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	if _, err := ts.Enroll(token, csr); !errors.Is(err, ErrTokenUsed) {
+		t.Errorf("token used again after a restart: %v", err)
+	}
+	if _, err := ts.GetUpstreamState("upstream-9"); err != nil {
+		t.Error("enrolled upstream lost after a restart")
+	}
+
+	cfg.SignerCert = nil
+	ts = newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	if _, err := ts.Enroll(token, csr); !errors.Is(err, ErrEnrollmentDisabled) {
+		t.Errorf("enrolled without a signer: %v", err)
+	}
+}
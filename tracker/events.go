@@ -0,0 +1,113 @@
+package tracker
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	EventAvailable      = "available"
+	EventUnavailable    = "unavailable"
+	EventAddressChanged = "address_changed"
+	EventDisabled       = "disabled"
+	EventEnabled        = "enabled"
+	EventAdded          = "added"
+	EventRemoved        = "removed"
+)
+
+// Event is a change in the state of an upstream
+type Event struct {
+	Type    string
+	Key     string
+	Address string
+	Time    time.Time
+}
+
+// Subscribe returns a channel receiving every upstream state change, and a
+// function to stop receiving them
+func (ts *TrackerServer) Subscribe(buffer int) (<-chan Event, func()) {
+	return ts.registry.events.subscribe(buffer)
+}
+
+// eventBus fans events out to subscribers. Delivery never blocks the
+// registry, events for a subscriber that is not keeping up are dropped.
+type eventBus struct {
+	lock        sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+func (b *eventBus) subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	b.lock.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.lock.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			b.lock.Lock()
+			delete(b.subscribers, ch)
+			b.lock.Unlock()
+			close(ch)
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+func (b *eventBus) publish(event Event) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Printf("dropping %s event for upstream %s, subscriber is not keeping up\n", event.Type, event.Key)
+		}
+	}
+}
+
+// upstreamEvents returns the events for the change from previous to current
+func upstreamEvents(previous *Upstream, current *Upstream, now time.Time) []Event {
+	var events []Event
+
+	add := func(eventType string) {
+		events = append(events, Event{
+			Type:    eventType,
+			Key:     current.Key,
+			Address: current.Address,
+			Time:    now,
+		})
+	}
+
+	if previous.Address != current.Address && previous.Address != "" {
+		add(EventAddressChanged)
+	}
+
+	if previous.Enabled != current.Enabled {
+		if current.Enabled {
+			add(EventEnabled)
+		} else {
+			add(EventDisabled)
+		}
+	}
+
+	if previous.Available != current.Available {
+		if current.Available {
+			add(EventAvailable)
+		} else {
+			add(EventUnavailable)
+		}
+	}
+
+	return events
+}
@@ -0,0 +1,73 @@
+package tracker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// virtual nodes per upstream, more points spread keys more evenly
+const hashRingReplicas = 128
+
+type ringPoint struct {
+	hash  uint64
+	index int
+}
+
+// HashRing maps keys to upstreams with consistent hashing, so adding or
+// removing an upstream only remaps the keys that land next to it
+type HashRing struct {
+	points    []ringPoint
+	upstreams []*Upstream
+}
+
+func NewHashRing(upstreams []*Upstream) *HashRing {
+	points := make([]ringPoint, 0, len(upstreams)*hashRingReplicas)
+
+	for index, u := range upstreams {
+		for i := 0; i < hashRingReplicas; i++ {
+			points = append(points, ringPoint{
+				hash:  ringHash(u.Key + "#" + strconv.Itoa(i)),
+				index: index,
+			})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+
+	return &HashRing{points: points, upstreams: upstreams}
+}
+
+// withUpstreams returns a ring over new versions of the same upstreams, in
+// the same order, without hashing them again
+func (r *HashRing) withUpstreams(upstreams []*Upstream) *HashRing {
+	return &HashRing{points: r.points, upstreams: upstreams}
+}
+
+// Get walks the ring clockwise from key and returns the first upstream that
+// passes the filter
+func (r *HashRing) Get(key string, filter UpstreamFilter) *Upstream {
+	n := len(r.points)
+
+	h := ringHash(key)
+	start := sort.Search(n, func(i int) bool {
+		return r.points[i].hash >= h
+	})
+
+	for i := 0; i < n; i++ {
+		u := r.upstreams[r.points[(start+i)%n].index]
+		if filter.Accepts(u) {
+			return u
+		}
+	}
+
+	return nil
+}
+
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,329 @@
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ca0s/despiste/config"
+	"github.com/pkg/errors"
+)
+
+const UpstreamKeysWatchInterval = 5 * time.Second
+
+var ErrUpstreamExists = errors.New("upstream already exists")
+var ErrStaticUpstream = errors.New("upstream is defined in the server config")
+var ErrInvalidUpstream = errors.New("invalid upstream")
+var ErrUpstreamKeysNotLoaded = errors.New("upstream keys file could not be loaded, fix it before changing upstreams")
+
+// upstreamKeys are the upstreams added at runtime. They are saved to the
+// keys file, if any, which is also reloaded when edited by hand.
+type upstreamKeys struct {
+	// serializes changes to the set of upstreams
+	lock   sync.Mutex
+	path   string
+	static map[string]struct{}
+	keys   []config.UpstreamConfig
+	// false while the file failed to load, saving would overwrite the
+	// upstreams in it that were never read
+	loaded bool
+}
+
+func newUpstreamKeys(path string, static []config.UpstreamConfig) *upstreamKeys {
+	k := &upstreamKeys{
+		path:   path,
+		static: make(map[string]struct{}, len(static)),
+		keys:   []config.UpstreamConfig{},
+	}
+
+	for _, upstreamConfig := range static {
+		k.static[upstreamConfig.Key] = struct{}{}
+	}
+
+	return k
+}
+
+// ReadUpstreamKeyFile reads a list of upstreams, given either as plain keys
+// or as objects with the same options as the server's upstreams key
+func ReadUpstreamKeyFile(path string) ([]config.UpstreamConfig, error) {
+	var keys []config.UpstreamConfig
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	err = json.NewDecoder(fd).Decode(&keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// read returns the upstreams in the keys file. A file with any invalid entry
+// is rejected as a whole, so a half edited file never removes upstreams.
+func (k *upstreamKeys) read() ([]config.UpstreamConfig, error) {
+	keys, err := ReadUpstreamKeyFile(k.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []config.UpstreamConfig{}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read upstream keys at %s", k.path)
+	}
+
+	result := []config.UpstreamConfig{}
+	seen := make(map[string]struct{}, len(keys))
+
+	for _, upstreamConfig := range keys {
+		if err := upstreamConfig.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid upstream keys at %s", k.path)
+		}
+
+		if _, ok := seen[upstreamConfig.Key]; ok {
+			return nil, fmt.Errorf("upstream %s is repeated in %s", upstreamConfig.Key, k.path)
+		}
+		seen[upstreamConfig.Key] = struct{}{}
+
+		if _, ok := k.static[upstreamConfig.Key]; ok {
+			log.Printf("ignoring upstream %s in %s, it is already in the server config\n", upstreamConfig.Key, k.path)
+			continue
+		}
+
+		result = append(result, upstreamConfig)
+	}
+
+	return result, nil
+}
+
+// save must be called with the lock held
+func (k *upstreamKeys) save(keys []config.UpstreamConfig) error {
+	if k.path != "" {
+		if !k.loaded {
+			return ErrUpstreamKeysNotLoaded
+		}
+
+		data, err := json.MarshalIndent(keys, "", "\t")
+		if err != nil {
+			return errors.Wrap(err, "could not encode upstream keys")
+		}
+
+		err = writeFileAtomic(k.path, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	k.keys = keys
+
+	return nil
+}
+
+func (k *upstreamKeys) index(key string) int {
+	return slices.IndexFunc(k.keys, func(upstreamConfig config.UpstreamConfig) bool {
+		return upstreamConfig.Key == key
+	})
+}
+
+// loadUpstreamKeys adds the upstreams in the keys file before the registry
+// is created
+func (ts *TrackerServer) loadUpstreamKeys(upstreams map[string]*Upstream) error {
+	keys, err := ts.keys.read()
+	if err != nil {
+		return err
+	}
+
+	for _, upstreamConfig := range keys {
+		upstreams[upstreamConfig.Key] = ts.newUpstream(upstreamConfig)
+	}
+
+	ts.keys.keys = keys
+	ts.keys.loaded = true
+
+	return nil
+}
+
+// AddUpstream registers a new upstream identity and saves it to the keys
+// file. It becomes available once it sends its keepalives.
+func (ts *TrackerServer) AddUpstream(upstreamConfig config.UpstreamConfig) (*UpstreamState, error) {
+	if err := upstreamConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidUpstream, err)
+	}
+
+	ts.keys.lock.Lock()
+	defer ts.keys.lock.Unlock()
+
+	current, exists := ts.registry.snapshot().upstreams[upstreamConfig.Key]
+	if exists && !current.AutoAdmitted {
+		return nil, ErrUpstreamExists
+	}
+
+	err := ts.keys.save(append(slices.Clone(ts.keys.keys), upstreamConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	// adding an auto admitted upstream keeps its state
+	if exists {
+		var state *UpstreamState
+
+		err = ts.registry.update(upstreamConfig.Key, func(upstream *Upstream) error {
+			upstream.applyConfig(upstreamConfig)
+			upstream.AutoAdmitted = false
+			state = upstream.state()
+			return nil
+		})
+
+		return state, err
+	}
+
+	upstream := ts.newUpstream(upstreamConfig)
+
+	err = ts.registry.add(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("upstream %s added\n", upstreamConfig.Key)
+
+	return upstream.state(), nil
+}
+
+// RemoveUpstream forgets an upstream added at runtime. Its active
+// connections are left to finish, upstreams in the server config can only be
+// disabled. Auto admitted upstreams register again on their next keepalive.
+func (ts *TrackerServer) RemoveUpstream(key string) error {
+	ts.keys.lock.Lock()
+	defer ts.keys.lock.Unlock()
+
+	if _, ok := ts.keys.static[key]; ok {
+		return ErrStaticUpstream
+	}
+
+	i := ts.keys.index(key)
+	if i < 0 {
+		if upstream, ok := ts.registry.snapshot().upstreams[key]; !ok || !upstream.AutoAdmitted {
+			return ErrNoSuchUpstream
+		}
+
+		return ts.registry.remove(key)
+	}
+
+	err := ts.keys.save(slices.Delete(slices.Clone(ts.keys.keys), i, i+1))
+	if err != nil {
+		return err
+	}
+
+	err = ts.registry.remove(key)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("upstream %s removed\n", key)
+
+	return nil
+}
+
+// ReloadUpstreamKeys applies the changes made to the keys file
+func (ts *TrackerServer) ReloadUpstreamKeys() error {
+	ts.keys.lock.Lock()
+	defer ts.keys.lock.Unlock()
+
+	keys, err := ts.keys.read()
+	if err != nil {
+		return err
+	}
+
+	added, updated, removed := 0, 0, 0
+
+	for _, upstreamConfig := range keys {
+		i := ts.keys.index(upstreamConfig.Key)
+
+		switch {
+		case i < 0:
+			err = ts.registry.add(ts.newUpstream(upstreamConfig))
+			if errors.Is(err, ErrUpstreamExists) {
+				// listing an auto admitted upstream takes it over
+				err = ts.registry.update(upstreamConfig.Key, func(upstream *Upstream) error {
+					upstream.applyConfig(upstreamConfig)
+					upstream.AutoAdmitted = false
+					return nil
+				})
+			}
+			added++
+		case !reflect.DeepEqual(ts.keys.keys[i], upstreamConfig):
+			err = ts.registry.update(upstreamConfig.Key, func(upstream *Upstream) error {
+				upstream.applyConfig(upstreamConfig)
+				return nil
+			})
+			updated++
+		}
+
+		if err != nil {
+			log.Printf("could not apply upstream %s: %s\n", upstreamConfig.Key, err)
+		}
+	}
+
+	for _, upstreamConfig := range ts.keys.keys {
+		if slices.ContainsFunc(keys, func(c config.UpstreamConfig) bool { return c.Key == upstreamConfig.Key }) {
+			continue
+		}
+
+		err = ts.registry.remove(upstreamConfig.Key)
+		if err != nil {
+			log.Printf("could not remove upstream %s: %s\n", upstreamConfig.Key, err)
+		}
+		removed++
+	}
+
+	ts.keys.keys = keys
+	ts.keys.loaded = true
+
+	if added+updated+removed > 0 {
+		log.Printf("reloaded upstream keys: %d added, %d updated, %d removed\n", added, updated, removed)
+	}
+
+	return nil
+}
+
+// WatchUpstreamKeys reloads the keys file whenever its modification time
+// changes
+func (ts *TrackerServer) WatchUpstreamKeys(interval time.Duration) {
+	var lastModified time.Time
+
+	if info, err := os.Stat(ts.keys.path); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	for {
+		time.Sleep(interval)
+
+		info, err := os.Stat(ts.keys.path)
+		if err != nil {
+			// not created until the first upstream is added
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("could not stat upstream keys at %s: %s\n", ts.keys.path, err)
+			}
+			continue
+		}
+
+		if info.ModTime().Equal(lastModified) {
+			continue
+		}
+
+		// a failed load is retried on the next tick, the file may be half written
+		err = ts.ReloadUpstreamKeys()
+		if err != nil {
+			log.Printf("could not reload upstream keys: %s\n", err)
+			continue
+		}
+
+		lastModified = info.ModTime()
+	}
+}
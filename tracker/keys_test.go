@@ -0,0 +1,159 @@
+package tracker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ca0s/despiste/config"
+)
+
+func TestRuntimeUpstreams(t *testing.T) {
+	cfg := testConfig(1, time.Minute)
+	cfg.UpstreamKeysFile = filepath.Join(t.TempDir(), "upstreams.json")
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	events, unsubscribe := ts.Subscribe(16)
+	defer unsubscribe()
+
+	_, err := ts.AddUpstream(config.UpstreamConfig{Key: "runtime-0", Tags: []string{"eu"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event := nextEvent(t, events); event.Type != EventAdded || event.Key != "runtime-0" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	if _, err := ts.AddUpstream(config.UpstreamConfig{Key: "upstream-0"}); !errors.Is(err, ErrUpstreamExists) {
+		t.Errorf("added an existing upstream: %v", err)
+	}
+	if _, err := ts.AddUpstream(config.UpstreamConfig{Key: "bad", Weight: -1}); !errors.Is(err, ErrInvalidUpstream) {
+		t.Errorf("added an invalid upstream: %v", err)
+	}
+
+	sendKeepalive(t, ts, "runtime-0", 41000)
+
+	if event := nextEvent(t, events); event.Type != EventAvailable {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	// runtime upstreams survive a restart through the keys file
+	restarted := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	if _, err := restarted.GetUpstreamState("runtime-0"); err != nil {
+		t.Error("runtime upstream lost after a restart")
+	}
+
+	if err := ts.RemoveUpstream("upstream-0"); !errors.Is(err, ErrStaticUpstream) {
+		t.Errorf("removed an upstream from the server config: %v", err)
+	}
+
+	if err := ts.RemoveUpstream("runtime-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if event := nextEvent(t, events); event.Type != EventUnavailable {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if event := nextEvent(t, events); event.Type != EventRemoved {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	keys, err := ReadUpstreamKeyFile(cfg.UpstreamKeysFile)
+	if err != nil || len(keys) != 0 {
+		t.Errorf("removed upstream still in the keys file: %v %v", keys, err)
+	}
+
+	checkConsistency(t, ts)
+}
+
+func TestReloadUpstreamKeys(t *testing.T) {
+	cfg := testConfig(1, time.Minute)
+	cfg.UpstreamKeysFile = filepath.Join(t.TempDir(), "upstreams.json")
+
+	write := func(data string) {
+		if err := os.WriteFile(cfg.UpstreamKeysFile, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`["runtime-0", {"key": "runtime-1", "tags": ["eu"]}]`)
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	sendKeepalive(t, ts, "runtime-1", 41001)
+
+	write(`[{"key": "runtime-1", "tags": ["us"], "max_connections": 2}, "runtime-2", "upstream-0"]`)
+
+	if err := ts.ReloadUpstreamKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	upstreams := ts.registry.snapshot().upstreams
+
+	if _, ok := upstreams["runtime-0"]; ok {
+		t.Error("upstream removed from the keys file is still registered")
+	}
+	if _, ok := upstreams["runtime-2"]; !ok {
+		t.Error("upstream added to the keys file is not registered")
+	}
+
+	// reported tags are kept, configured ones replaced
+	runtime1 := upstreams["runtime-1"]
+	if !runtime1.Available || runtime1.MaxConnections != 2 || !slices.Equal(runtime1.Tags, []string{"us", "test"}) {
+		t.Errorf("runtime-1 not updated: %+v", runtime1)
+	}
+
+	write(`["runtime-2", {"key": "broken", "weight": -1}]`)
+
+	if err := ts.ReloadUpstreamKeys(); err == nil {
+		t.Error("loaded an invalid keys file")
+	}
+	if _, ok := ts.registry.snapshot().upstreams["runtime-1"]; !ok {
+		t.Error("invalid keys file removed upstreams")
+	}
+
+	checkConsistency(t, ts)
+}
+
+func TestInvalidUpstreamKeysAreNotOverwritten(t *testing.T) {
+	cfg := testConfig(1, time.Minute)
+	cfg.UpstreamKeysFile = filepath.Join(t.TempDir(), "upstreams.json")
+
+	invalid := `["runtime-0", {"key": "broken", "weight": -1}]`
+	if err := os.WriteFile(cfg.UpstreamKeysFile, []byte(invalid), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	if _, err := ts.AddUpstream(config.UpstreamConfig{Key: "runtime-1"}); !errors.Is(err, ErrUpstreamKeysNotLoaded) {
+		t.Errorf("added an upstream over an invalid keys file: %v", err)
+	}
+
+	if data, _ := os.ReadFile(cfg.UpstreamKeysFile); string(data) != invalid {
+		t.Fatalf("invalid keys file overwritten with %s", data)
+	}
+
+	if err := os.WriteFile(cfg.UpstreamKeysFile, []byte(`["runtime-0"]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.ReloadUpstreamKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ts.AddUpstream(config.UpstreamConfig{Key: "runtime-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := ReadUpstreamKeyFile(cfg.UpstreamKeysFile)
+	if err != nil || len(keys) != 2 {
+		t.Errorf("fixed keys file not kept: %v %v", keys, err)
+	}
+
+	checkConsistency(t, ts)
+}
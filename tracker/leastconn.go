@@ -0,0 +1,31 @@
+package tracker
+
+type LeastConnectionsSelector struct {
+	offset uint32
+}
+
+func NewLeastConnectionsSelector() *LeastConnectionsSelector {
+	return &LeastConnectionsSelector{}
+}
+
+func (l *LeastConnectionsSelector) Next(upstreams []*Upstream, filter UpstreamFilter) *Upstream {
+	return minimumBy(upstreams, &l.offset, filter, func(u *Upstream) int64 {
+		return u.ActiveConnections()
+	})
+}
+
+// LatencySelector prefers the upstream with the lowest median handshake plus
+// connect time. Upstreams without measurements yet are tried first.
+type LatencySelector struct {
+	offset uint32
+}
+
+func NewLatencySelector() *LatencySelector {
+	return &LatencySelector{}
+}
+
+func (l *LatencySelector) Next(upstreams []*Upstream, filter UpstreamFilter) *Upstream {
+	return minimumBy(upstreams, &l.offset, filter, func(u *Upstream) int64 {
+		return int64(u.Latency())
+	})
+}
@@ -0,0 +1,196 @@
+package tracker
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// number of recent samples percentiles are computed over
+const MetricsWindow = 128
+
+// connections moving less than this are too short to measure throughput
+const minThroughputBytes = 64 * 1024
+
+// Percentiles of the samples in the window. Durations are in nanoseconds and
+// throughput in bytes per second.
+type Percentiles struct {
+	Samples int
+	P50     int64
+	P90     int64
+	P99     int64
+}
+
+type UpstreamMetrics struct {
+	HandshakeRTT  Percentiles
+	ConnectTime   Percentiles
+	Throughput    Percentiles
+	BytesSent     int64
+	BytesReceived int64
+}
+
+// upstreamMetrics measures real traffic through an upstream
+type upstreamMetrics struct {
+	lock sync.Mutex
+
+	handshake  sampleWindow
+	connect    sampleWindow
+	throughput sampleWindow
+
+	bytesSent     int64
+	bytesReceived int64
+
+	// median handshake plus connect time, read without the lock by selectors
+	medianLatency int64
+}
+
+func (m *upstreamMetrics) observeHandshake(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.handshake.add(int64(d))
+	m.updateLatency()
+}
+
+func (m *upstreamMetrics) observeConnect(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.connect.add(int64(d))
+	m.updateLatency()
+}
+
+func (m *upstreamMetrics) observeTransfer(sent int64, received int64, d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.bytesSent += sent
+	m.bytesReceived += received
+
+	if sent+received >= minThroughputBytes && d > 0 {
+		m.throughput.add(int64(float64(sent+received) / d.Seconds()))
+	}
+}
+
+// latency is the median time it takes to get a connection through the
+// upstream, or 0 while it has not been measured
+func (m *upstreamMetrics) latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.medianLatency))
+}
+
+// updateLatency must be called with the lock held
+func (m *upstreamMetrics) updateLatency() {
+	atomic.StoreInt64(&m.medianLatency, m.handshake.percentile(50)+m.connect.percentile(50))
+}
+
+func (m *upstreamMetrics) snapshot() UpstreamMetrics {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return UpstreamMetrics{
+		HandshakeRTT:  m.handshake.percentiles(),
+		ConnectTime:   m.connect.percentiles(),
+		Throughput:    m.throughput.percentiles(),
+		BytesSent:     m.bytesSent,
+		BytesReceived: m.bytesReceived,
+	}
+}
+
+// metricsState is the persisted form of upstreamMetrics
+type metricsState struct {
+	Handshake     []int64
+	Connect       []int64
+	Throughput    []int64
+	BytesSent     int64
+	BytesReceived int64
+}
+
+func (m *upstreamMetrics) export() *metricsState {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return &metricsState{
+		Handshake:     m.handshake.ordered(),
+		Connect:       m.connect.ordered(),
+		Throughput:    m.throughput.ordered(),
+		BytesSent:     m.bytesSent,
+		BytesReceived: m.bytesReceived,
+	}
+}
+
+func (m *upstreamMetrics) restore(state *metricsState) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, sample := range state.Handshake {
+		m.handshake.add(sample)
+	}
+	for _, sample := range state.Connect {
+		m.connect.add(sample)
+	}
+	for _, sample := range state.Throughput {
+		m.throughput.add(sample)
+	}
+
+	m.bytesSent += state.BytesSent
+	m.bytesReceived += state.BytesReceived
+
+	m.updateLatency()
+}
+
+// sampleWindow keeps the last MetricsWindow samples
+type sampleWindow struct {
+	samples []int64
+	next    int
+}
+
+func (w *sampleWindow) add(sample int64) {
+	if len(w.samples) < MetricsWindow {
+		w.samples = append(w.samples, sample)
+		return
+	}
+
+	w.samples[w.next] = sample
+	w.next = (w.next + 1) % MetricsWindow
+}
+
+// ordered returns the samples from oldest to newest
+func (w *sampleWindow) ordered() []int64 {
+	return append(slices.Clone(w.samples[w.next:]), w.samples[:w.next]...)
+}
+
+func (w *sampleWindow) percentile(p int) int64 {
+	return percentile(sortedCopy(w.samples), p)
+}
+
+func (w *sampleWindow) percentiles() Percentiles {
+	sorted := sortedCopy(w.samples)
+
+	return Percentiles{
+		Samples: len(sorted),
+		P50:     percentile(sorted, 50),
+		P90:     percentile(sorted, 90),
+		P99:     percentile(sorted, 99),
+	}
+}
+
+func sortedCopy(samples []int64) []int64 {
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// percentile uses the nearest rank method on sorted samples
+func percentile(sorted []int64, p int) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
@@ -0,0 +1,129 @@
+package tracker
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ca0s/despiste/certificates"
+)
+
+func TestPercentile(t *testing.T) {
+	sequence := func(from int64, to int64) []int64 {
+		var samples []int64
+		for i := from; i <= to; i++ {
+			samples = append(samples, i)
+		}
+		return samples
+	}
+
+	tests := []struct {
+		sorted []int64
+		want   Percentiles
+	}{
+		{sorted: nil, want: Percentiles{}},
+		{sorted: []int64{7}, want: Percentiles{Samples: 1, P50: 7, P90: 7, P99: 7}},
+		{sorted: sequence(1, 10), want: Percentiles{Samples: 10, P50: 5, P90: 9, P99: 10}},
+		{sorted: sequence(1, 100), want: Percentiles{Samples: 100, P50: 50, P90: 90, P99: 99}},
+	}
+
+	for _, test := range tests {
+		window := sampleWindow{}
+
+		// the window sorts its samples itself
+		for i := len(test.sorted) - 1; i >= 0; i-- {
+			window.add(test.sorted[i])
+		}
+
+		if got := window.percentiles(); got != test.want {
+			t.Errorf("%d samples: got %+v, want %+v", len(test.sorted), got, test.want)
+		}
+
+		if got := window.percentile(50); got != test.want.P50 {
+			t.Errorf("%d samples: got median %d, want %d", len(test.sorted), got, test.want.P50)
+		}
+	}
+}
+
+func TestSampleWindowRolls(t *testing.T) {
+	window := sampleWindow{}
+
+	for i := int64(1); i <= MetricsWindow+10; i++ {
+		window.add(i)
+	}
+
+	ordered := window.ordered()
+	if len(ordered) != MetricsWindow || ordered[0] != 11 || ordered[len(ordered)-1] != MetricsWindow+10 {
+		t.Fatalf("window holds %d samples from %d to %d", len(ordered), ordered[0], ordered[len(ordered)-1])
+	}
+
+	// 128 samples from 11 to 138, ranked 64, 116 and 127
+	want := Percentiles{Samples: MetricsWindow, P50: 74, P90: 126, P99: 137}
+	if got := window.percentiles(); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	// a restored window keeps the same samples in the same order
+	var restored upstreamMetrics
+	restored.restore(&metricsState{Handshake: ordered})
+
+	if !slices.Equal(restored.handshake.ordered(), ordered) {
+		t.Error("restored window differs")
+	}
+}
+
+func TestUpstreamMetricsAPI(t *testing.T) {
+	cfg := testConfig(1, time.Minute)
+	cfg.Admins = []string{"ops"}
+
+	ts := newTestServer(t, cfg, SelectorLatency, AffinityNone)
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	upstream := ts.registry.snapshot().upstreams["upstream-0"]
+
+	for _, d := range []time.Duration{30, 10, 20} {
+		upstream.ObserveHandshake(d * time.Millisecond)
+	}
+	upstream.ObserveConnect(5 * time.Millisecond)
+
+	upstream.ObserveTransfer(32*1024, 32*1024, time.Second)
+	upstream.ObserveTransfer(2*1024*1024, 0, 2*time.Second)
+	// too short to say anything about throughput
+	upstream.ObserveTransfer(100, 100, time.Millisecond)
+
+	recorder := apiRequest(ts, testCertificate("ops", certificates.RoleAdmin), http.MethodGet, "/api/upstreams", "")
+
+	var upstreams map[string]struct {
+		Latency time.Duration
+		Metrics UpstreamMetrics
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &upstreams); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d: %v", recorder.Code, err)
+	}
+
+	got := upstreams["upstream-0"]
+
+	if got.Latency != 25*time.Millisecond {
+		t.Errorf("got latency %s, want the median handshake plus connect time", got.Latency)
+	}
+
+	handshake := Percentiles{Samples: 3, P50: int64(20 * time.Millisecond), P90: int64(30 * time.Millisecond), P99: int64(30 * time.Millisecond)}
+	if got.Metrics.HandshakeRTT != handshake {
+		t.Errorf("got handshake %+v, want %+v", got.Metrics.HandshakeRTT, handshake)
+	}
+
+	if got.Metrics.ConnectTime.Samples != 1 || got.Metrics.ConnectTime.P99 != int64(5*time.Millisecond) {
+		t.Errorf("got connect time %+v", got.Metrics.ConnectTime)
+	}
+
+	throughput := Percentiles{Samples: 2, P50: 64 * 1024, P90: 1024 * 1024, P99: 1024 * 1024}
+	if got.Metrics.Throughput != throughput {
+		t.Errorf("got throughput %+v, want %+v", got.Metrics.Throughput, throughput)
+	}
+
+	if got.Metrics.BytesSent != 32*1024+2*1024*1024+100 || got.Metrics.BytesReceived != 32*1024+100 {
+		t.Errorf("got %d bytes sent and %d received", got.Metrics.BytesSent, got.Metrics.BytesReceived)
+	}
+}
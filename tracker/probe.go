@@ -0,0 +1,56 @@
+package tracker
+
+import (
+	"log"
+	"time"
+)
+
+// ProbeTarget is an upstream the server should health check
+type ProbeTarget struct {
+	Key     string
+	Address string
+}
+
+type ProbeResult struct {
+	Time  time.Time
+	Error string `json:",omitempty"`
+}
+
+// ProbeTargets returns every upstream whose address is known
+func (ts *TrackerServer) ProbeTargets() []ProbeTarget {
+	var targets []ProbeTarget
+
+	ts.registry.view(func(upstreams map[string]*Upstream) {
+		for _, upstream := range upstreams {
+			if upstream.Address != "" {
+				targets = append(targets, ProbeTarget{Key: upstream.Key, Address: upstream.Address})
+			}
+		}
+	})
+
+	return targets
+}
+
+// ReportProbe records the outcome of a health probe. An upstream failing its
+// probe is unavailable even if it keeps sending keepalives, and becomes
+// available again once a probe succeeds while its keepalives are current.
+func (ts *TrackerServer) ReportProbe(key string, err error) {
+	ts.registry.update(key, func(upstream *Upstream) error {
+		result := &ProbeResult{Time: time.Now()}
+		if err != nil {
+			result.Error = err.Error()
+		}
+
+		switch {
+		case err != nil && upstream.Reachable:
+			log.Printf("upstream %s failed its health probe: %s\n", key, err)
+		case err == nil && !upstream.Reachable:
+			log.Printf("upstream %s passed its health probe\n", key)
+		}
+
+		upstream.LastProbe = result
+		upstream.Reachable = err == nil
+
+		return nil
+	})
+}
@@ -0,0 +1,49 @@
+package tracker
+
+import "math/rand"
+
+type RandomSelector struct{}
+
+func NewRandomSelector() *RandomSelector {
+	return &RandomSelector{}
+}
+
+func (r *RandomSelector) Next(upstreams []*Upstream, filter UpstreamFilter) *Upstream {
+	n := countAccepted(upstreams, filter)
+	if n == 0 {
+		return nil
+	}
+
+	return nthAccepted(upstreams, filter, rand.Intn(n))
+}
+
+// PowerOfTwoSelector picks two random upstreams and keeps the one with less
+// active connections, which avoids the herding of plain least connections
+type PowerOfTwoSelector struct{}
+
+func NewPowerOfTwoSelector() *PowerOfTwoSelector {
+	return &PowerOfTwoSelector{}
+}
+
+func (p *PowerOfTwoSelector) Next(upstreams []*Upstream, filter UpstreamFilter) *Upstream {
+	n := countAccepted(upstreams, filter)
+	switch n {
+	case 0:
+		return nil
+	case 1:
+		return nthAccepted(upstreams, filter, 0)
+	}
+
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := nthAccepted(upstreams, filter, i), nthAccepted(upstreams, filter, j)
+	if b.ActiveConnections() < a.ActiveConnections() {
+		return b
+	}
+
+	return a
+}
@@ -0,0 +1,269 @@
+package tracker
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// registry holds the upstreams known to the tracker. Changes go through
+// update, which works on a copy of the upstream and publishes a new
+// snapshot with it. Readers, including every connection selecting an
+// upstream, only ever see published snapshots and take no locks.
+type registry struct {
+	// serializes writers, readers use current
+	lock      sync.Mutex
+	upstreams map[string]*Upstream
+	current   atomic.Pointer[snapshot]
+
+	deadline time.Duration
+	affinity *Affinity
+	events   *eventBus
+
+	// notified whenever an upstream may have become selectable
+	available *broadcaster
+	// wakes the reaper up when an upstream starts counting down its deadline
+	reschedule chan struct{}
+}
+
+// snapshot is an immutable view of the registry
+type snapshot struct {
+	upstreams map[string]*Upstream
+	// sorted by key
+	available []*Upstream
+	ring      *HashRing
+}
+
+func newRegistry(upstreams map[string]*Upstream, affinity *Affinity, deadline time.Duration, available *broadcaster) *registry {
+	r := &registry{
+		upstreams:  upstreams,
+		deadline:   deadline,
+		affinity:   affinity,
+		events:     newEventBus(),
+		available:  available,
+		reschedule: make(chan struct{}, 1),
+	}
+
+	r.publish()
+
+	return r
+}
+
+func (r *registry) snapshot() *snapshot {
+	return r.current.Load()
+}
+
+// view runs f on the current snapshot
+func (r *registry) view(f func(upstreams map[string]*Upstream)) {
+	f(r.snapshot().upstreams)
+}
+
+// update runs f on a new version of the upstream and publishes it, making
+// the upstream available or unavailable according to its new state
+func (r *registry) update(key string, f func(u *Upstream) error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	current, ok := r.upstreams[key]
+	if !ok {
+		return ErrNoSuchUpstream
+	}
+
+	upstream := current.clone()
+
+	err := f(upstream)
+	if err != nil {
+		return err
+	}
+
+	r.setAvailable(upstream, upstream.Address != "" && upstream.Reachable && upstream.IsAlive(r.deadline))
+	events := r.replace(current, upstream)
+	r.publish()
+	r.send(events)
+
+	if upstream.Available && !current.Available {
+		r.available.notify()
+
+		select {
+		case r.reschedule <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// add registers a new upstream
+func (r *registry) add(upstream *Upstream) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.upstreams[upstream.Key]; ok {
+		return ErrUpstreamExists
+	}
+
+	r.upstreams[upstream.Key] = upstream
+	r.publish()
+	r.send([]Event{{
+		Type: EventAdded,
+		Key:  upstream.Key,
+		Time: time.Now(),
+	}})
+
+	return nil
+}
+
+// remove drops an upstream, its active connections are left to finish
+func (r *registry) remove(key string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	upstream, ok := r.upstreams[key]
+	if !ok {
+		return ErrNoSuchUpstream
+	}
+
+	delete(r.upstreams, key)
+
+	var events []Event
+
+	now := time.Now()
+	if upstream.Available {
+		events = append(events, Event{Type: EventUnavailable, Key: key, Address: upstream.Address, Time: now})
+	}
+	events = append(events, Event{Type: EventRemoved, Key: key, Address: upstream.Address, Time: now})
+
+	r.publish()
+	r.send(events)
+
+	return nil
+}
+
+// replace must be called with the lock held. It returns the events for the
+// change, to be sent once the snapshot including it is published.
+func (r *registry) replace(previous *Upstream, upstream *Upstream) []Event {
+	r.upstreams[upstream.Key] = upstream
+
+	return upstreamEvents(previous, upstream, time.Now())
+}
+
+// send must be called with the lock held, after publishing the snapshot the
+// events describe, so subscribers looking at the registry see their effect
+func (r *registry) send(events []Event) {
+	for _, event := range events {
+		r.events.publish(event)
+	}
+}
+
+// reap expires upstreams right when their keepalive deadline passes, so
+// selections never have to check liveness themselves
+func (r *registry) reap() {
+	timer := time.NewTimer(0)
+	sweep := time.NewTicker(affinitySweepInterval)
+
+	for {
+		select {
+		case <-timer.C:
+		case <-r.reschedule:
+			timer.Stop()
+		case now := <-sweep.C:
+			r.affinity.sweep(now)
+			continue
+		}
+
+		next := r.expire()
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// expire makes upstreams past their deadline unavailable and returns the
+// time the next one is due, or zero if no upstream is available
+func (r *registry) expire() time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var next time.Time
+	var events []Event
+	expired := false
+
+	for _, current := range r.upstreams {
+		if !current.Available {
+			continue
+		}
+
+		if current.IsAlive(r.deadline) {
+			due := current.KeepAlive.Add(r.deadline)
+			if next.IsZero() || due.Before(next) {
+				next = due
+			}
+			continue
+		}
+
+		upstream := current.clone()
+		upstream.Provisional = false
+		r.setAvailable(upstream, false)
+		events = append(events, r.replace(current, upstream)...)
+		expired = true
+	}
+
+	if expired {
+		r.publish()
+		r.send(events)
+	}
+
+	return next
+}
+
+// setAvailable must be called with the lock held
+func (r *registry) setAvailable(upstream *Upstream, available bool) {
+	if available == upstream.Available {
+		return
+	}
+
+	upstream.Available = available
+
+	if available {
+		log.Printf("upstream %s is now available at %s!\n", upstream.Key, upstream.Address)
+	} else {
+		log.Printf("upstream %s is no longer available!\n", upstream.Key)
+	}
+}
+
+// publish must be called with the lock held
+func (r *registry) publish() {
+	next := &snapshot{
+		upstreams: make(map[string]*Upstream, len(r.upstreams)),
+	}
+
+	for key, upstream := range r.upstreams {
+		next.upstreams[key] = upstream
+		if upstream.Available {
+			next.available = append(next.available, upstream)
+		}
+	}
+
+	slices.SortFunc(next.available, func(a, b *Upstream) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	// hashing is only redone when the available set changes
+	previous := r.current.Load()
+	if previous != nil && sameKeys(previous.available, next.available) {
+		next.ring = previous.ring.withUpstreams(next.available)
+	} else {
+		next.ring = NewHashRing(next.available)
+	}
+
+	r.current.Store(next)
+}
+
+func sameKeys(a []*Upstream, b []*Upstream) bool {
+	return slices.EqualFunc(a, b, func(x, y *Upstream) bool {
+		return x.Key == y.Key
+	})
+}
@@ -0,0 +1,702 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ca0s/despiste/config"
+	"github.com/labstack/echo/v4"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func testConfig(upstreams int, deadline time.Duration) *config.Config {
+	cfg := &config.Config{
+		UpstreamDeadline: deadline,
+		AffinityTTL:      time.Minute,
+		BreakerThreshold: 3,
+		BreakerBackoff:   time.Millisecond,
+	}
+
+	for i := 0; i < upstreams; i++ {
+		cfg.Upstreams = append(cfg.Upstreams, config.UpstreamConfig{
+			Key:            fmt.Sprintf("upstream-%d", i),
+			Weight:         i + 1,
+			MaxConnections: 4,
+		})
+	}
+
+	return cfg
+}
+
+func newTestServer(tb testing.TB, cfg *config.Config, selectorName string, affinityMode string) *TrackerServer {
+	tb.Helper()
+
+	selector, err := NewSelector(selectorName)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	affinity, err := NewAffinity(affinityMode, cfg.AffinityTTL)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return NewTrackerServer(cfg, selector, affinity, nil)
+}
+
+func sendKeepalive(tb testing.TB, ts *TrackerServer, key string, port int) {
+	err := ts.UpdateUpstreamKeepalive(key, &KeepAliveRequest{
+		ClientKey: key,
+		Address:   fmt.Sprintf("127.0.0.1:%d", port),
+		Tags:      []string{"test"},
+		Load:      &UpstreamLoad{ActiveConnections: int64(port % 3)},
+	}, "127.0.0.1:40000", time.Now().Add(time.Hour))
+	if err != nil {
+		tb.Error(err)
+	}
+}
+
+func readUpstreams(t *testing.T, ts *TrackerServer) {
+	e := echo.New()
+	recorder := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/upstreams", nil), recorder)
+
+	err := getUpstreams(TrackerContext{Context: c, server: ts})
+	if err != nil || recorder.Code != http.StatusOK {
+		t.Errorf("getUpstreams: %v, status %d", err, recorder.Code)
+	}
+}
+
+// checkConsistency verifies the snapshot lists exactly the available upstreams
+func checkConsistency(t *testing.T, ts *TrackerServer) {
+	t.Helper()
+
+	snapshot := ts.registry.snapshot()
+
+	available := 0
+	for _, u := range snapshot.upstreams {
+		if u.Available {
+			available++
+		}
+	}
+
+	if len(snapshot.available) != available {
+		t.Errorf("snapshot lists %d upstreams, %d are available", len(snapshot.available), available)
+	}
+
+	for _, u := range snapshot.available {
+		if snapshot.upstreams[u.Key] != u {
+			t.Errorf("snapshot lists a stale version of %s", u.Key)
+		}
+	}
+}
+
+var testSelectors = []string{
+	SelectorRoundRobin,
+	SelectorWeightedRoundRobin,
+	SelectorRandom,
+	SelectorLeastConnections,
+	SelectorLatency,
+	SelectorPowerOfTwo,
+}
+
+func TestRegistryConcurrentAccess(t *testing.T) {
+	for _, name := range testSelectors {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig(8, time.Minute)
+			cfg.ProbeInterval = time.Second
+
+			ts := newTestServer(t, cfg, name, AffinityClientDestination)
+
+			const iterations = 200
+			var wg sync.WaitGroup
+
+			run := func(f func(i int)) {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < iterations; i++ {
+						f(i)
+					}
+				}()
+			}
+
+			for u := 0; u < 8; u++ {
+				key := fmt.Sprintf("upstream-%d", u)
+
+				run(func(i int) {
+					sendKeepalive(t, ts, key, 41000+i%4)
+				})
+
+				run(func(i int) {
+					if i%5 == 0 {
+						ts.ReportProbe(key, errors.New("probe failed"))
+					} else {
+						ts.ReportProbe(key, nil)
+					}
+				})
+			}
+
+			for c := 0; c < 8; c++ {
+				client := fmt.Sprintf("client-%d", c)
+
+				run(func(i int) {
+					ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+					defer cancel()
+
+					upstream, err := ts.GetUpstream(ctx, &SelectionRequest{
+						ClientID:    client,
+						Destination: fmt.Sprintf("host-%d", i%3),
+					})
+					if err != nil {
+						return
+					}
+
+					upstream.ObserveHandshake(time.Millisecond)
+					if i%7 == 0 {
+						upstream.DialFailed()
+					} else {
+						upstream.DialSucceeded()
+					}
+					upstream.ConnectionClosed()
+				})
+			}
+
+			run(func(i int) {
+				readUpstreams(t, ts)
+				ts.ProbeTargets()
+				ts.GetUpstreamState("upstream-0")
+			})
+
+			run(func(i int) {
+				states := []string{UpstreamStateDisabled, UpstreamStateDraining, UpstreamStateEnabled}
+				_, err := ts.SetUpstreamState(fmt.Sprintf("upstream-%d", i%8), states[i%3])
+				if err != nil {
+					t.Error(err)
+				}
+			})
+
+			wg.Wait()
+
+			checkConsistency(t, ts)
+
+			ts.registry.view(func(upstreams map[string]*Upstream) {
+				for _, u := range upstreams {
+					if u.ActiveConnections() != 0 {
+						t.Errorf("upstream %s has %d connections left", u.Key, u.ActiveConnections())
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestRegistryExpiresUpstreams(t *testing.T) {
+	ts := newTestServer(t, testConfig(1, 20*time.Millisecond), SelectorRoundRobin, AffinityNone)
+
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	upstream, err := ts.GetUpstream(context.Background(), &SelectionRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.ConnectionClosed()
+
+	time.Sleep(30 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err = ts.GetUpstream(ctx, &SelectionRequest{})
+	if err == nil {
+		t.Fatal("selected an upstream whose keepalives stopped")
+	}
+
+	state, _ := ts.GetUpstreamState("upstream-0")
+	if state.Available {
+		t.Error("expired upstream is still available")
+	}
+
+	checkConsistency(t, ts)
+}
+
+func TestRegistryRequiresProbe(t *testing.T) {
+	cfg := testConfig(1, time.Minute)
+	cfg.ProbeInterval = time.Second
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	state, _ := ts.GetUpstreamState("upstream-0")
+	if state.Available {
+		t.Fatal("upstream available before passing a probe")
+	}
+
+	ts.ReportProbe("upstream-0", nil)
+
+	state, _ = ts.GetUpstreamState("upstream-0")
+	if !state.Available {
+		t.Fatal("upstream unavailable after passing a probe")
+	}
+
+	ts.ReportProbe("upstream-0", errors.New("probe failed"))
+
+	state, _ = ts.GetUpstreamState("upstream-0")
+	if state.Available {
+		t.Fatal("upstream available after failing a probe")
+	}
+
+	checkConsistency(t, ts)
+}
+
+func TestGetUpstreamWaitsForKeepalive(t *testing.T) {
+	ts := newTestServer(t, testConfig(1, time.Minute), SelectorRoundRobin, AffinityNone)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		sendKeepalive(t, ts, "upstream-0", 41000)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	upstream, err := ts.GetUpstream(ctx, &SelectionRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upstream.Key != "upstream-0" {
+		t.Errorf("got upstream %s", upstream.Key)
+	}
+}
+
+func TestGetUpstreamSkipsFullUpstreams(t *testing.T) {
+	cfg := testConfig(2, time.Minute)
+	cfg.Upstreams[0].MaxConnections = 1
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	sendKeepalive(t, ts, "upstream-0", 41000)
+	sendKeepalive(t, ts, "upstream-1", 41001)
+
+	picks := map[string]int{}
+	for i := 0; i < 5; i++ {
+		upstream, err := ts.GetUpstream(context.Background(), &SelectionRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[upstream.Key]++
+	}
+
+	if picks["upstream-0"] != 1 || picks["upstream-1"] != 4 {
+		t.Errorf("got picks %v", picks)
+	}
+
+	// without a queue timeout a full pool fails right away
+	start := time.Now()
+	_, err := ts.GetUpstream(context.Background(), &SelectionRequest{})
+	if !errors.Is(err, ErrUpstreamsFull) || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestGetUpstreamQueuesForSlot(t *testing.T) {
+	cfg := testConfig(1, time.Minute)
+	cfg.Upstreams[0].MaxConnections = 1
+	cfg.QueueTimeout = time.Second
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	held, err := ts.GetUpstream(context.Background(), &SelectionRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		held.ConnectionClosed()
+	}()
+
+	start := time.Now()
+
+	upstream, err := ts.GetUpstream(context.Background(), &SelectionRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if waited := time.Since(start); waited < 50*time.Millisecond || waited > 500*time.Millisecond {
+		t.Errorf("waited %s for the released slot", waited)
+	}
+
+	if upstream.Key != "upstream-0" || upstream.ActiveConnections() != 1 {
+		t.Errorf("got upstream %s with %d connections", upstream.Key, upstream.ActiveConnections())
+	}
+}
+
+func TestGetUpstreamQueueTimeout(t *testing.T) {
+	cfg := testConfig(1, time.Minute)
+	cfg.Upstreams[0].MaxConnections = 1
+	cfg.QueueTimeout = 50 * time.Millisecond
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	if _, err := ts.GetUpstream(context.Background(), &SelectionRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err := ts.GetUpstream(ctx, &SelectionRequest{})
+
+	if !errors.Is(err, ErrUpstreamsFull) {
+		t.Fatalf("got %v, want %v", err, ErrUpstreamsFull)
+	}
+
+	if waited := time.Since(start); waited < cfg.QueueTimeout || waited > time.Second {
+		t.Errorf("gave up after %s", waited)
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+
+	return Event{}
+}
+
+func TestRegistryEvents(t *testing.T) {
+	deadline := 50 * time.Millisecond
+	ts := newTestServer(t, testConfig(1, deadline), SelectorRoundRobin, AffinityNone)
+
+	events, unsubscribe := ts.Subscribe(16)
+	defer unsubscribe()
+
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	event := nextEvent(t, events)
+	if event.Type != EventAvailable || event.Key != "upstream-0" || event.Address != "127.0.0.1:41000" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	sendKeepalive(t, ts, "upstream-0", 41001)
+
+	if event = nextEvent(t, events); event.Type != EventAddressChanged || event.Address != "127.0.0.1:41001" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	ts.SetUpstreamState("upstream-0", UpstreamStateDisabled)
+
+	if event = nextEvent(t, events); event.Type != EventDisabled {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	state, _ := ts.GetUpstreamState("upstream-0")
+	if !state.Available {
+		t.Error("disabled upstream should still be alive")
+	}
+
+	lastKeepalive := time.Now()
+	sendKeepalive(t, ts, "upstream-0", 41001)
+
+	event = nextEvent(t, events)
+	if event.Type != EventUnavailable {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	// the reaper fires at the deadline instead of on the next selection
+	late := event.Time.Sub(lastKeepalive.Add(deadline))
+	if late < 0 || late > 50*time.Millisecond {
+		t.Errorf("upstream expired %s after its deadline", late)
+	}
+}
+
+func TestRegistryEventsFollowSnapshot(t *testing.T) {
+	deadline := 200 * time.Millisecond
+	ts := newTestServer(t, testConfig(1, deadline), SelectorRoundRobin, AffinityNone)
+
+	events, unsubscribe := ts.Subscribe(16)
+	defer unsubscribe()
+
+	// subscribers looking at the registry when an event arrives see its effect
+	checked := make(chan struct{})
+	go func() {
+		for event := range events {
+			upstream, exists := ts.registry.snapshot().upstreams[event.Key]
+
+			var ok bool
+			switch event.Type {
+			case EventAvailable:
+				ok = exists && upstream.Available
+			case EventUnavailable:
+				ok = !exists || !upstream.Available
+			case EventDisabled:
+				ok = exists && !upstream.Enabled
+			case EventEnabled:
+				ok = exists && upstream.Enabled
+			case EventAdded:
+				ok = exists
+			case EventRemoved:
+				ok = !exists
+			}
+
+			if !ok {
+				t.Errorf("%s event for %s before the snapshot shows it", event.Type, event.Key)
+			}
+
+			checked <- struct{}{}
+		}
+	}()
+
+	// each change is checked before the next one is made
+	wait := func() {
+		t.Helper()
+
+		select {
+		case <-checked:
+		case <-time.After(time.Second):
+			t.Fatal("no event received")
+		}
+	}
+
+	sendKeepalive(t, ts, "upstream-0", 41000)
+	wait()
+
+	for i := 0; i < 20; i++ {
+		ts.SetUpstreamState("upstream-0", UpstreamStateDisabled)
+		wait()
+		ts.SetUpstreamState("upstream-0", UpstreamStateEnabled)
+		wait()
+
+		if err := ts.registry.add(NewUpstream("upstream-extra", "")); err != nil {
+			t.Fatal(err)
+		}
+		wait()
+		// it goes unavailable, then away
+		if err := ts.registry.remove("upstream-extra"); err != nil {
+			t.Fatal(err)
+		}
+		wait()
+		wait()
+	}
+
+	// and the reaper expiring upstream-0
+	wait()
+}
+
+// lockedBuffer collects log output written from any goroutine
+type lockedBuffer struct {
+	lock sync.Mutex
+	data []byte
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return string(b.data)
+}
+
+func TestKeepaliveAddresses(t *testing.T) {
+	var logs lockedBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(io.Discard)
+
+	cfg := testConfig(2, time.Minute)
+	cfg.Upstreams[1].UseSourceAddress = true
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	keepalive := func(key string, address string, source string) *Upstream {
+		t.Helper()
+
+		err := ts.UpdateUpstreamKeepalive(key, &KeepAliveRequest{ClientKey: key, Address: address}, source, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ts.registry.snapshot().upstreams[key]
+	}
+
+	warnings := func() int {
+		return strings.Count(logs.String(), "WARN: upstream")
+	}
+
+	// behind NAT the upstream only knows its port
+	upstream := keepalive("upstream-1", "0.0.0.0:41001", "203.0.113.5:5555")
+	if upstream.Address != "203.0.113.5:41001" || upstream.AdvertisedAddress != "0.0.0.0:41001" || upstream.ObservedAddress != "203.0.113.5" {
+		t.Errorf("source address not used: %+v", upstream)
+	}
+
+	upstream = keepalive("upstream-0", "10.0.0.1:41000", "203.0.113.6:5555")
+	if upstream.Address != "10.0.0.1:41000" || upstream.ObservedAddress != "203.0.113.6" {
+		t.Errorf("advertised address not used: %+v", upstream)
+	}
+
+	keepalive("upstream-0", "10.0.0.1:41000", "203.0.113.6:6666")
+	if warnings() != 1 {
+		t.Errorf("%d warnings for one address mismatch", warnings())
+	}
+
+	keepalive("upstream-0", "203.0.113.6:41000", "203.0.113.6:5555")
+	keepalive("upstream-1", "0.0.0.0:41001", "203.0.113.7:5555")
+	if warnings() != 1 {
+		t.Errorf("%d warnings, matching addresses were reported", warnings())
+	}
+
+	for i := 0; i < AddressHistoryLength+5; i++ {
+		keepalive("upstream-0", fmt.Sprintf("203.0.113.6:%d", 42000+i), "203.0.113.6:5555")
+	}
+
+	history := ts.registry.snapshot().upstreams["upstream-0"].AddressHistory
+	if len(history) != AddressHistoryLength || history[len(history)-1].Address != fmt.Sprintf("203.0.113.6:%d", 42000+AddressHistoryLength+4) {
+		t.Errorf("unexpected address history %+v", history)
+	}
+}
+
+func TestTagRouting(t *testing.T) {
+	cfg := testConfig(3, time.Minute)
+	cfg.Upstreams[0].Tags = []string{"eu"}
+	cfg.ClientPolicies = map[string]config.ClientPolicy{
+		"restricted": {Tags: []string{"premium"}},
+	}
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	keepalive := func(key string, port int, tags ...string) {
+		t.Helper()
+
+		err := ts.UpdateUpstreamKeepalive(key, &KeepAliveRequest{
+			ClientKey: key,
+			Address:   fmt.Sprintf("127.0.0.1:%d", port),
+			Tags:      tags,
+		}, "127.0.0.1:40000", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keepalive("upstream-0", 41000, "premium")
+	keepalive("upstream-1", 41001, "eu")
+	keepalive("upstream-2", 41002, "us", "premium")
+
+	tests := []struct {
+		request *SelectionRequest
+		want    []string
+	}{
+		{request: &SelectionRequest{}, want: []string{"upstream-0", "upstream-1", "upstream-2"}},
+		{request: &SelectionRequest{Tags: []string{"eu"}}, want: []string{"upstream-0", "upstream-1"}},
+		{request: &SelectionRequest{Tags: []string{"eu", "premium"}}, want: []string{"upstream-0"}},
+		{request: &SelectionRequest{ClientID: "restricted"}, want: []string{"upstream-0", "upstream-2"}},
+		{request: &SelectionRequest{ClientID: "restricted", Tags: []string{"us"}}, want: []string{"upstream-2"}},
+		{request: &SelectionRequest{ClientID: "restricted", Upstream: "upstream-1"}},
+		{request: &SelectionRequest{Tags: []string{"asia"}}},
+	}
+
+	for _, test := range tests {
+		picked := map[string]bool{}
+
+		for i := 0; i < 12; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			upstream, err := ts.GetUpstream(ctx, test.request)
+			cancel()
+
+			if err != nil {
+				if len(test.want) != 0 && !errors.Is(err, ErrNoMatchingUpstream) {
+					t.Errorf("%+v: %v", test.request, err)
+				}
+				break
+			}
+
+			picked[upstream.Key] = true
+			upstream.ConnectionClosed()
+		}
+
+		if len(picked) != len(test.want) {
+			t.Errorf("%+v: picked %v, want %v", test.request, picked, test.want)
+		}
+
+		for _, key := range test.want {
+			if !picked[key] {
+				t.Errorf("%+v: %s never picked", test.request, key)
+			}
+		}
+	}
+}
+
+func TestTagMerging(t *testing.T) {
+	cfg := testConfig(1, time.Minute)
+	cfg.Upstreams[0].Tags = []string{"eu", "premium"}
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	keepalive := func(tags ...string) []string {
+		t.Helper()
+
+		err := ts.UpdateUpstreamKeepalive("upstream-0", &KeepAliveRequest{
+			ClientKey: "upstream-0",
+			Address:   "127.0.0.1:41000",
+			Tags:      tags,
+		}, "127.0.0.1:40000", time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ts.registry.snapshot().upstreams["upstream-0"].Tags
+	}
+
+	if tags := keepalive("premium", "fast"); !slices.Equal(tags, []string{"eu", "premium", "fast"}) {
+		t.Errorf("got tags %v", tags)
+	}
+
+	// reported tags are replaced by the next keepalive, configured ones stay
+	if tags := keepalive("ipv6"); !slices.Equal(tags, []string{"eu", "premium", "ipv6"}) {
+		t.Errorf("got tags %v", tags)
+	}
+
+	if tags := keepalive(); !slices.Equal(tags, []string{"eu", "premium"}) {
+		t.Errorf("got tags %v", tags)
+	}
+
+	upstream := NewUpstream("upstream-1", "127.0.0.1:41001")
+	upstream.applyConfig(config.UpstreamConfig{Tags: []string{"eu"}})
+	upstream.Tags = mergeTags(upstream.configTags, []string{"fast"})
+
+	// a config change keeps the reported tags
+	upstream.applyConfig(config.UpstreamConfig{Tags: []string{"us"}})
+	if !slices.Equal(upstream.Tags, []string{"us", "fast"}) {
+		t.Errorf("got tags %v after a config change", upstream.Tags)
+	}
+}
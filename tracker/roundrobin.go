@@ -6,47 +6,25 @@ import (
 
 type (
 	UpstreamRoundRobin struct {
-		values []*Upstream
-		nitems int
-		index  int32
+		index uint32
 	}
 )
 
-func NewUpstreamRoundRobin(values []*Upstream) *UpstreamRoundRobin {
-	return &UpstreamRoundRobin{
-		values: values,
-		nitems: len(values),
-	}
-}
-
-func (rr *UpstreamRoundRobin) Next() *Upstream {
-	n := atomic.AddInt32(&rr.index, 1)
-	return rr.values[int(n-1)%rr.nitems]
+func NewUpstreamRoundRobin() *UpstreamRoundRobin {
+	return &UpstreamRoundRobin{}
 }
 
-func (rr *UpstreamRoundRobin) Len() int {
-	return rr.nitems
-}
+func (rr *UpstreamRoundRobin) Next(upstreams []*Upstream, filter UpstreamFilter) *Upstream {
+	nitems := uint32(len(upstreams))
 
-func (rr *UpstreamRoundRobin) Add(n *Upstream) {
-	// not thread safe, lock something before calling this
-	rr.values = append(rr.values, n)
-	rr.nitems++
-}
+	for i := uint32(0); i < nitems; i++ {
+		n := atomic.AddUint32(&rr.index, 1)
+		u := upstreams[int((n-1)%nitems)]
 
-func (rr *UpstreamRoundRobin) Remove(u *Upstream) {
-	// not thread safe, lock something before calling this
-	itemPos := -1
-	for i := range rr.values {
-		if u == rr.values[i] {
-			itemPos = i
-			break
+		if filter.Accepts(u) {
+			return u
 		}
 	}
 
-	if itemPos >= 0 {
-		rr.values[itemPos] = rr.values[len(rr.values)-1]
-		rr.values = rr.values[:len(rr.values)-1]
-		rr.nitems--
-	}
+	return nil
 }
@@ -0,0 +1,106 @@
+package tracker
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	SelectorRoundRobin         = "round_robin"
+	SelectorWeightedRoundRobin = "weighted_round_robin"
+	SelectorRandom             = "random"
+	SelectorLeastConnections   = "least_connections"
+	SelectorLatency            = "latency"
+	SelectorPowerOfTwo         = "power_of_two"
+)
+
+// Selector picks the upstream for each new connection among the available
+// ones that pass the filter, returning nil if none does. Next is called
+// concurrently and without locks, the list is an immutable snapshot.
+type Selector interface {
+	Next(upstreams []*Upstream, filter UpstreamFilter) *Upstream
+}
+
+// UpstreamFilter restricts the upstreams a selection may return, nil accepts all
+type UpstreamFilter func(*Upstream) bool
+
+func (f UpstreamFilter) Accepts(u *Upstream) bool {
+	return f == nil || f(u)
+}
+
+func NewSelector(name string) (Selector, error) {
+	switch name {
+	case "", SelectorRoundRobin:
+		return NewUpstreamRoundRobin(), nil
+	case SelectorWeightedRoundRobin:
+		return NewWeightedRoundRobin(), nil
+	case SelectorRandom:
+		return NewRandomSelector(), nil
+	case SelectorLeastConnections:
+		return NewLeastConnectionsSelector(), nil
+	case SelectorLatency:
+		return NewLatencySelector(), nil
+	case SelectorPowerOfTwo:
+		return NewPowerOfTwoSelector(), nil
+	}
+
+	return nil, fmt.Errorf("unknown upstream selector %q", name)
+}
+
+// countAccepted returns how many upstreams pass the filter
+func countAccepted(upstreams []*Upstream, filter UpstreamFilter) int {
+	n := 0
+	for _, u := range upstreams {
+		if filter.Accepts(u) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// nthAccepted returns the n-th upstream, counting from 0, that passes the filter
+func nthAccepted(upstreams []*Upstream, filter UpstreamFilter, n int) *Upstream {
+	for _, u := range upstreams {
+		if !filter.Accepts(u) {
+			continue
+		}
+
+		if n == 0 {
+			return u
+		}
+		n--
+	}
+
+	return nil
+}
+
+// minimumBy returns the upstream with the lowest score, starting the scan at
+// a rotating offset so ties are spread across upstreams
+func minimumBy(upstreams []*Upstream, offset *uint32, filter UpstreamFilter, score func(*Upstream) int64) *Upstream {
+	n := len(upstreams)
+	if n == 0 {
+		return nil
+	}
+
+	start := int(atomic.AddUint32(offset, 1) % uint32(n))
+
+	var best *Upstream
+	var bestScore int64
+
+	for i := 0; i < n; i++ {
+		u := upstreams[(start+i)%n]
+		if !filter.Accepts(u) {
+			continue
+		}
+
+		s := score(u)
+
+		if best == nil || s < bestScore {
+			best = u
+			bestScore = s
+		}
+	}
+
+	return best
+}
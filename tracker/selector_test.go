@@ -0,0 +1,239 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runCallers splits b.N calls to f among the given number of goroutines
+func runCallers(b *testing.B, callers int, f func(i int64)) {
+	var next int64
+	var wg sync.WaitGroup
+
+	b.ResetTimer()
+
+	for c := 0; c < callers; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := atomic.AddInt64(&next, 1); i <= int64(b.N); i = atomic.AddInt64(&next, 1) {
+				f(i)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func benchmarkGetUpstream(b *testing.B, selectorName string, affinityMode string, callers int) {
+	cfg := testConfig(16, time.Minute)
+	for i := range cfg.Upstreams {
+		cfg.Upstreams[i].MaxConnections = 0
+	}
+
+	ts := newTestServer(b, cfg, selectorName, affinityMode)
+	for _, upstream := range cfg.Upstreams {
+		sendKeepalive(b, ts, upstream.Key, 41000)
+	}
+
+	ctx := context.Background()
+	destinations := make([]string, 64)
+	for i := range destinations {
+		destinations[i] = fmt.Sprintf("host-%d", i)
+	}
+
+	runCallers(b, callers, func(i int64) {
+		upstream, err := ts.GetUpstream(ctx, &SelectionRequest{
+			ClientID:    "client",
+			Destination: destinations[i%int64(len(destinations))],
+		})
+		if err != nil {
+			b.Error(err)
+			return
+		}
+
+		upstream.ConnectionClosed()
+	})
+}
+
+func BenchmarkGetUpstream(b *testing.B) {
+	for _, name := range testSelectors {
+		for _, callers := range []int{1, 16, 256} {
+			b.Run(fmt.Sprintf("%s/callers=%d", name, callers), func(b *testing.B) {
+				benchmarkGetUpstream(b, name, AffinityNone, callers)
+			})
+		}
+	}
+
+	for _, callers := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("affinity/callers=%d", callers), func(b *testing.B) {
+			benchmarkGetUpstream(b, SelectorRoundRobin, AffinityClientDestination, callers)
+		})
+	}
+}
+
+func TestWeightedRoundRobinForgetsUpstreams(t *testing.T) {
+	w := NewWeightedRoundRobin()
+
+	for i := 0; i < 100; i++ {
+		upstreams := []*Upstream{
+			NewUpstream("upstream-stable", "127.0.0.1:1"),
+			NewUpstream(fmt.Sprintf("upstream-%d", i), "127.0.0.1:2"),
+		}
+
+		if w.Next(upstreams, nil) == nil {
+			t.Fatal("no upstream selected")
+		}
+
+		for key := range w.current {
+			if key != upstreams[0].Key && key != upstreams[1].Key {
+				t.Fatalf("%s is still weighted", key)
+			}
+		}
+	}
+}
+
+func testUpstreams(n int) []*Upstream {
+	upstreams := make([]*Upstream, n)
+	for i := range upstreams {
+		upstreams[i] = NewUpstream(fmt.Sprintf("upstream-%d", i), fmt.Sprintf("127.0.0.1:%d", 41000+i))
+	}
+
+	return upstreams
+}
+
+// countPicks runs n selections and counts how often each upstream was picked
+func countPicks(selector Selector, upstreams []*Upstream, filter UpstreamFilter, n int) map[string]int {
+	picks := make(map[string]int)
+	for i := 0; i < n; i++ {
+		if u := selector.Next(upstreams, filter); u != nil {
+			picks[u.Key]++
+		}
+	}
+
+	return picks
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	upstreams := testUpstreams(3)
+	skipFirst := UpstreamFilter(func(u *Upstream) bool { return u != upstreams[0] })
+
+	picks := countPicks(NewUpstreamRoundRobin(), upstreams, nil, 30)
+	for _, u := range upstreams {
+		if picks[u.Key] != 10 {
+			t.Errorf("%s picked %d times out of 30", u.Key, picks[u.Key])
+		}
+	}
+
+	picks = countPicks(NewUpstreamRoundRobin(), upstreams, skipFirst, 30)
+	if picks["upstream-0"] != 0 || picks["upstream-1"]+picks["upstream-2"] != 30 {
+		t.Errorf("filter not applied: %v", picks)
+	}
+}
+
+func TestWeightedRoundRobinFollowsWeights(t *testing.T) {
+	upstreams := testUpstreams(3)
+	for i, u := range upstreams {
+		u.Weight = i + 1
+	}
+
+	w := NewWeightedRoundRobin()
+
+	// every round of 6 picks follows the weights exactly
+	for round := 0; round < 5; round++ {
+		picks := countPicks(w, upstreams, nil, 6)
+		for _, u := range upstreams {
+			if picks[u.Key] != u.Weight {
+				t.Fatalf("round %d: %s picked %d times, weight %d", round, u.Key, picks[u.Key], u.Weight)
+			}
+		}
+	}
+
+	// the heaviest upstream is interleaved with the rest instead of picked in a burst
+	upstreams[2].Weight = 4
+	w = NewWeightedRoundRobin()
+
+	expected := []int{2, 1, 2, 0, 2, 1, 2}
+	for i, index := range expected {
+		if u := w.Next(upstreams, nil); u != upstreams[index] {
+			t.Fatalf("pick %d is %s, want %s", i, u.Key, upstreams[index].Key)
+		}
+	}
+
+	skipHeaviest := UpstreamFilter(func(u *Upstream) bool { return u != upstreams[2] })
+	if picks := countPicks(NewWeightedRoundRobin(), upstreams, skipHeaviest, 6); picks["upstream-0"] != 2 || picks["upstream-1"] != 4 {
+		t.Errorf("filtered picks %v do not follow the remaining weights", picks)
+	}
+}
+
+func TestLeastConnectionsSelector(t *testing.T) {
+	upstreams := testUpstreams(3)
+	for i, connections := range []int{3, 1, 2} {
+		for j := 0; j < connections; j++ {
+			upstreams[i].ConnectionOpened()
+		}
+	}
+
+	selector := NewLeastConnectionsSelector()
+
+	if picks := countPicks(selector, upstreams, nil, 10); picks["upstream-1"] != 10 {
+		t.Errorf("least loaded upstream not picked: %v", picks)
+	}
+
+	skipLeast := UpstreamFilter(func(u *Upstream) bool { return u != upstreams[1] })
+	if picks := countPicks(selector, upstreams, skipLeast, 10); picks["upstream-2"] != 10 {
+		t.Errorf("least loaded accepted upstream not picked: %v", picks)
+	}
+
+	// ties are spread instead of always going to the first one
+	upstreams[1].ConnectionOpened()
+	if picks := countPicks(selector, upstreams, nil, 10); picks["upstream-1"] == 0 || picks["upstream-2"] == 0 || picks["upstream-0"] != 0 {
+		t.Errorf("ties not spread: %v", picks)
+	}
+}
+
+func TestLatencySelector(t *testing.T) {
+	upstreams := testUpstreams(3)
+	upstreams[0].ObserveHandshake(30 * time.Millisecond)
+	upstreams[1].ObserveHandshake(10 * time.Millisecond)
+	upstreams[1].ObserveConnect(15 * time.Millisecond)
+
+	selector := NewLatencySelector()
+
+	// upstreams with no measurements are tried first
+	if picks := countPicks(selector, upstreams, nil, 5); picks["upstream-2"] != 5 {
+		t.Errorf("unmeasured upstream not tried first: %v", picks)
+	}
+
+	upstreams[2].ObserveHandshake(50 * time.Millisecond)
+
+	if picks := countPicks(selector, upstreams, nil, 5); picks["upstream-1"] != 5 {
+		t.Errorf("fastest upstream not picked: %v", picks)
+	}
+}
+
+func TestPowerOfTwoSelector(t *testing.T) {
+	upstreams := testUpstreams(3)
+	for i, connections := range []int{0, 5, 10} {
+		for j := 0; j < connections; j++ {
+			upstreams[i].ConnectionOpened()
+		}
+	}
+
+	selector := NewPowerOfTwoSelector()
+
+	// the most loaded upstream always loses the comparison
+	picks := countPicks(selector, upstreams, nil, 300)
+	if picks["upstream-2"] != 0 || picks["upstream-0"] <= picks["upstream-1"] {
+		t.Errorf("unexpected picks %v", picks)
+	}
+
+	onlyLoaded := UpstreamFilter(func(u *Upstream) bool { return u == upstreams[2] })
+	if picks := countPicks(selector, upstreams, onlyLoaded, 5); picks["upstream-2"] != 5 {
+		t.Errorf("single accepted upstream not picked: %v", picks)
+	}
+}
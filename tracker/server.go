@@ -1,25 +1,51 @@
 package tracker
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"log"
+	"net"
 	"net/http"
-	"sync"
+	"slices"
 	"time"
 
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/config"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 )
 
 type TrackerServer struct {
-	listenAddress  string
-	upstreams      map[string]*Upstream
-	clientDeadline time.Duration
-
-	serverCert string
-
-	upstreamLock *sync.RWMutex
-	upstreamRR   *UpstreamRoundRobin
+	listenAddress string
+	registry      *registry
+	selector      Selector
+	affinity      *Affinity
+
+	tlsConfig  *tls.Config
+	revocation *certificates.RevocationChecker
+
+	clientPolicies map[string]config.ClientPolicy
+	admins         []string
+
+	// requests wait this long for a connection slot when upstreams are full
+	queueTimeout time.Duration
+	released     *broadcaster
+	// notified whenever an upstream may have become selectable
+	available *broadcaster
+
+	// for upstreams added at runtime
+	breakerConfig BreakerConfig
+	probing       bool
+	keys          *upstreamKeys
+
+	// register unknown upstreams with the upstream certificate role
+	autoAdmit        bool
+	autoAdmitPattern string
+
+	// nil unless an enrollment signer is configured
+	enrollment *enrollment
 }
 
 type TrackerContext struct {
@@ -30,32 +56,117 @@ type TrackerContext struct {
 
 var ErrNoUpstreamsAvailable = errors.New("no upstreams available")
 var ErrNoSuchUpstream = errors.New("invalid upstream key")
+var ErrInvalidAddress = errors.New("invalid upstream address")
+var ErrUpstreamUnavailable = errors.New("requested upstream is not available")
+var ErrNoMatchingUpstream = errors.New("no available upstream matches the request")
+var ErrUpstreamsFull = errors.New("all matching upstreams are at capacity")
+var ErrNoPeerCertificate = errors.New("no client certificate presented")
+var ErrIdentityMismatch = errors.New("client key does not match the client certificate")
+var ErrNotUpstream = errors.New("client certificate does not have the upstream role")
+
+func NewTrackerServer(cfg *config.Config, selector Selector, affinity *Affinity, tlsConfig *tls.Config) *TrackerServer {
+	released := newBroadcaster()
+	available := newBroadcaster()
+
+	ts := &TrackerServer{
+		listenAddress: cfg.TrackerAddress,
+		selector:      selector,
+		affinity:      affinity,
+
+		clientPolicies: cfg.ClientPolicies,
+		admins:         cfg.Admins,
+
+		queueTimeout: cfg.QueueTimeout,
+		released:     released,
+		available:    available,
+
+		breakerConfig: BreakerConfig{
+			Threshold:  cfg.BreakerThreshold,
+			Backoff:    cfg.BreakerBackoff,
+			MaxBackoff: cfg.BreakerMaxBackoff,
+			OnReady:    available.notify,
+		},
+		probing: cfg.ProbeInterval > 0,
+		keys:    newUpstreamKeys(cfg.UpstreamKeysFile, cfg.Upstreams),
+
+		autoAdmit:        cfg.AutoAdmitUpstreams,
+		autoAdmitPattern: cfg.AutoAdmitPattern,
+
+		tlsConfig:  tlsConfig,
+		revocation: cfg.Revocation,
+	}
+
+	if cfg.SignerCert != nil {
+		enrollment, err := newEnrollment(cfg)
+		if err != nil {
+			log.Printf("enrollment disabled: %s\n", err)
+		} else {
+			ts.enrollment = enrollment
+		}
+	}
 
-func NewTrackerServer(listenAddress string, clientKeys []string, clientDeadline time.Duration, certFile string) *TrackerServer {
 	upstreams := make(map[string]*Upstream)
+	for _, upstreamConfig := range cfg.Upstreams {
+		upstreams[upstreamConfig.Key] = ts.newUpstream(upstreamConfig)
+	}
+
+	if cfg.UpstreamKeysFile != "" {
+		err := ts.loadUpstreamKeys(upstreams)
+		if err != nil {
+			log.Printf("WARN: could not load upstream keys, adding and removing upstreams is refused until the file is fixed: %s\n", err)
+		}
+	}
 
-	for _, key := range clientKeys {
-		upstreams[key] = &Upstream{
-			Address:   "",
-			Key:       key,
-			KeepAlive: time.Now(),
-			Enabled:   true,
-			Available: false,
+	if cfg.StateFile != "" {
+		err := ts.restoreState(cfg.StateFile, upstreams, cfg.UpstreamDeadline)
+		if err != nil {
+			log.Printf("could not restore tracker state: %s\n", err)
 		}
 	}
 
-	return &TrackerServer{
-		listenAddress:  listenAddress,
-		upstreams:      upstreams,
-		clientDeadline: clientDeadline,
-		upstreamLock:   &sync.RWMutex{},
-		upstreamRR:     NewUpstreamRoundRobin(nil),
+	ts.registry = newRegistry(upstreams, affinity, cfg.UpstreamDeadline, available)
+	go ts.registry.reap()
+
+	return ts
+}
+
+func (ts *TrackerServer) newUpstream(upstreamConfig config.UpstreamConfig) *Upstream {
+	return &Upstream{
+		Address:   "",
+		Key:       upstreamConfig.Key,
+		KeepAlive: time.Now(),
+		Enabled:   true,
+		Available: false,
+		Weight:    upstreamConfig.Weight,
+		Tags:      upstreamConfig.Tags,
+
+		MaxConnections: upstreamConfig.MaxConnections,
+
+		UseSourceAddress: upstreamConfig.UseSourceAddress,
+
+		// with probing enabled, upstreams must pass a probe before use
+		Reachable: !ts.probing,
 
-		serverCert: certFile,
+		configTags: upstreamConfig.Tags,
+		runtime: &upstreamRuntime{
+			released: ts.released,
+			breaker:  NewCircuitBreaker(upstreamConfig.Key, ts.breakerConfig),
+		},
 	}
 }
 
 func (ts *TrackerServer) Run() error {
+	e := ts.router()
+
+	e.TLSServer.Addr = ts.listenAddress
+	e.TLSServer.TLSConfig = ts.tlsConfig
+
+	return e.StartServer(e.TLSServer)
+}
+
+// router sets up the tracker API, kept apart from Run so it can be served
+// without a listener
+func (ts *TrackerServer) router() *echo.Echo {
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
@@ -64,80 +175,233 @@ func (ts *TrackerServer) Run() error {
 	e.Use(ContextMiddleware(ts))
 
 	e.POST("/api/keepalive", withContext(upstreamKeepAlive))
-	e.GET("/api/upstreams", withContext(getUpstreams))
+	e.GET("/api/upstreams", withContext(readersOnly(getUpstreams)))
+	e.GET("/api/crl", withContext(getCRL))
 
-	return e.StartTLS(ts.listenAddress, ts.serverCert, ts.serverCert)
+	e.GET("/api/upstreams/:key", withContext(readersOnly(getUpstreamState)))
+	e.POST("/api/upstreams/:key/enable", withContext(adminOnly(setUpstreamState(UpstreamStateEnabled))))
+	e.POST("/api/upstreams/:key/disable", withContext(adminOnly(setUpstreamState(UpstreamStateDisabled))))
+	e.POST("/api/upstreams/:key/drain", withContext(adminOnly(setUpstreamState(UpstreamStateDraining))))
+	e.POST("/api/upstreams", withContext(adminOnly(addUpstream)))
+	e.DELETE("/api/upstreams/:key", withContext(adminOnly(removeUpstream)))
 
-	//return e.Start(ts.listenAddress)
+	return e
 }
 
-func (ts *TrackerServer) GetUpstream() (*Upstream, error) {
+// GetUpstream picks an upstream for the request and reserves a connection
+// slot on it, which the caller must release with ConnectionClosed. While no
+// upstream can take the request it waits for one until ctx is done, and for
+// a free slot up to the queue timeout when every matching upstream is full.
+func (ts *TrackerServer) GetUpstream(ctx context.Context, request *SelectionRequest) (*Upstream, error) {
+	var released, available, queueTimeout <-chan struct{}
+
 	for {
-		ts.upstreamLock.RLock()
-		// cannot defer unlock due to the following conditions
+		upstream, err := ts.reserveUpstream(request)
+
+		switch err {
+		case ErrUpstreamsFull:
+			if ts.queueTimeout <= 0 {
+				return nil, err
+			}
 
-		if ts.upstreamRR.Len() == 0 {
-			ts.upstreamLock.RUnlock()
-			return nil, ErrNoUpstreamsAvailable
+			if queueTimeout == nil {
+				timeout, cancel := context.WithTimeout(context.Background(), ts.queueTimeout)
+				defer cancel()
+				queueTimeout = timeout.Done()
+			}
+		case ErrNoUpstreamsAvailable, ErrNoMatchingUpstream, ErrUpstreamUnavailable:
+		default:
+			return upstream, err
 		}
 
-		upstream := ts.upstreamRR.Next()
-		ts.upstreamLock.RUnlock()
+		if released != nil {
+			select {
+			case <-released:
+			case <-available:
+			case <-queueTimeout:
+				return nil, err
+			case <-ctx.Done():
+				return nil, err
+			}
+		}
 
-		if upstream.IsAlive(ts.clientDeadline) {
-			return upstream, nil
-		} else {
-			// this call needs the mutex to be unlocked
-			ts.removeAvailableUpstream(upstream)
+		// subscribe before checking again, so a change in between is not missed
+		released = ts.released.wait()
+		available = ts.available.wait()
+	}
+}
+
+func (ts *TrackerServer) reserveUpstream(request *SelectionRequest) (*Upstream, error) {
+	filter := ts.selectionFilter(request)
+	snapshot := ts.registry.snapshot()
+
+	if request != nil && request.Upstream != "" {
+		return ts.getNamedUpstream(snapshot, request.Upstream, filter)
+	}
+
+	if len(snapshot.available) == 0 {
+		return nil, ErrNoUpstreamsAvailable
+	}
+
+	full := false
+
+	for {
+		upstream := ts.nextUpstream(snapshot, request, capacityFilter(filter, &full))
+		if upstream == nil {
+			if full {
+				return nil, ErrUpstreamsFull
+			}
+			return nil, ErrNoMatchingUpstream
 		}
+
+		if !upstream.reserveConnection(upstream.connectionLimit()) {
+			// the last slot was taken since it was selected
+			full = true
+			filter = excludeUpstream(filter, upstream)
+			continue
+		}
+
+		if !upstream.breaker().Admit() {
+			// another connection took the half-open trial first
+			upstream.ConnectionClosed()
+			filter = excludeUpstream(filter, upstream)
+			continue
+		}
+
+		return upstream, nil
 	}
 }
 
-func (ts *TrackerServer) UpdateUpstreamKeepalive(upstreamKey string, address string) error {
-	upstream, ok := ts.upstreams[upstreamKey]
+func (ts *TrackerServer) UpdateUpstreamKeepalive(upstreamKey string, request *KeepAliveRequest, sourceAddress string, certificateExpiry time.Time) error {
+	address := request.Address
+
+	advertisedHost, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return ErrInvalidAddress
+	}
+
+	sourceHost, _, err := net.SplitHostPort(sourceAddress)
+	if err != nil {
+		return ErrInvalidAddress
+	}
+
+	return ts.registry.update(upstreamKey, func(upstream *Upstream) error {
+		now := time.Now()
+
+		if !sameHost(advertisedHost, sourceHost) && (address != upstream.AdvertisedAddress || sourceHost != upstream.ObservedAddress) {
+			log.Printf("WARN: upstream %s advertises %s but connects from %s\n", upstream.Key, address, sourceHost)
+		}
+
+		upstream.KeepAlive = now
+		upstream.Tags = mergeTags(upstream.configTags, request.Tags)
+		upstream.AdvertisedAddress = address
+		upstream.ObservedAddress = sourceHost
+		upstream.Load = request.Load
+		upstream.CertificateExpiry = certificateExpiry
+		upstream.Provisional = false
+
+		if upstream.UseSourceAddress {
+			upstream.setAddress(net.JoinHostPort(sourceHost, port), now)
+		} else {
+			upstream.setAddress(address, now)
+		}
+
+		return nil
+	})
+}
+
+func (ts *TrackerServer) getNamedUpstream(snapshot *snapshot, key string, filter UpstreamFilter) (*Upstream, error) {
+	upstream, ok := snapshot.upstreams[key]
 	if !ok {
-		return ErrNoSuchUpstream
+		return nil, ErrNoSuchUpstream
+	}
+
+	if !upstream.Available || !upstream.Enabled {
+		return nil, ErrUpstreamUnavailable
 	}
 
-	upstream.KeepAlive = time.Now()
-	upstream.Address = address
+	if !filter.Accepts(upstream) {
+		return nil, ErrNoMatchingUpstream
+	}
 
-	if !upstream.Available {
-		ts.addAvailableUpstream(upstream)
+	if !upstream.HasCapacity() || !upstream.reserveConnection(upstream.connectionLimit()) {
+		return nil, ErrUpstreamsFull
 	}
 
-	return nil
+	if !upstream.breaker().Admit() {
+		upstream.ConnectionClosed()
+		return nil, ErrUpstreamUnavailable
+	}
+
+	return upstream, nil
+}
+
+func (ts *TrackerServer) nextUpstream(snapshot *snapshot, request *SelectionRequest, filter UpstreamFilter) *Upstream {
+	key := ts.affinity.Key(request)
+	if key == "" {
+		return ts.selector.Next(snapshot.available, filter)
+	}
+
+	return ts.affinity.get(snapshot, key, filter)
 }
 
-func (ts *TrackerServer) addAvailableUpstream(upstream *Upstream) {
-	ts.upstreamLock.Lock()
-	defer ts.upstreamLock.Unlock()
+// selectionFilter restricts the selection to enabled upstreams carrying both
+// the tags requested by the client and the ones mandated by its policy
+func (ts *TrackerServer) selectionFilter(request *SelectionRequest) UpstreamFilter {
+	var tags []string
+	var exclude []string
+
+	if request != nil {
+		exclude = request.Exclude
+		tags = request.Tags
+		if policy, ok := ts.clientPolicies[request.ClientID]; ok {
+			tags = append(tags[:len(tags):len(tags)], policy.Tags...)
+		}
+	}
 
-	// another routine could have entered here between the previous check and now
-	if upstream.Available {
-		return
+	return func(u *Upstream) bool {
+		return u.Enabled && u.HasTags(tags) && !slices.Contains(exclude, u.Key) && u.breaker().Selectable()
 	}
+}
 
-	log.Printf("upstream %s is now available at %s!\n", upstream.Key, upstream.Address)
+// capacityFilter also skips upstreams with no free connection slots, and
+// records in full whether any otherwise matching upstream was skipped
+func capacityFilter(filter UpstreamFilter, full *bool) UpstreamFilter {
+	return func(u *Upstream) bool {
+		if !filter.Accepts(u) {
+			return false
+		}
 
-	ts.upstreamRR.Add(upstream)
-	upstream.Available = true
+		if !u.HasCapacity() {
+			*full = true
+			return false
+		}
 
+		return true
+	}
 }
 
-func (ts *TrackerServer) removeAvailableUpstream(upstream *Upstream) {
-	ts.upstreamLock.Lock()
-	defer ts.upstreamLock.Unlock()
+func excludeUpstream(filter UpstreamFilter, excluded *Upstream) UpstreamFilter {
+	return func(u *Upstream) bool {
+		return u != excluded && filter.Accepts(u)
+	}
+}
 
-	// another routine could have entered here between previous check and now
-	if !upstream.Available {
-		return
+// sameHost reports whether an advertised host matches the observed one. A
+// wildcard advertised host does not claim any address so it never conflicts.
+func sameHost(advertised string, observed string) bool {
+	if advertised == "" {
+		return true
 	}
 
-	log.Printf("upstream %s is no longer available!\n", upstream.Key)
+	advertisedIP := net.ParseIP(advertised)
+	observedIP := net.ParseIP(observed)
+
+	if advertisedIP == nil || observedIP == nil {
+		return advertised == observed
+	}
 
-	ts.upstreamRR.Remove(upstream)
-	upstream.Available = false
+	return advertisedIP.IsUnspecified() || advertisedIP.Equal(observedIP)
 }
 
 func withContext(f func(TrackerContext) error) func(echoCtx echo.Context) error {
@@ -166,12 +430,36 @@ func ContextMiddleware(ts *TrackerServer) echo.MiddlewareFunc {
 func upstreamKeepAlive(c TrackerContext) error {
 	var request KeepAliveRequest
 
-	err := c.Bind(&request)
+	cert, err := peerCertificate(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, ApiError{err.Error()})
+	}
+
+	identity := cert.Subject.CommonName
+
+	if !certificates.HasRole(cert, certificates.RoleUpstream) {
+		log.Printf("%s sent a keepalive without an upstream certificate, rejecting\n", identity)
+		return c.JSON(http.StatusForbidden, ApiError{ErrNotUpstream.Error()})
+	}
+
+	err = c.Bind(&request)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, ApiError{""})
 	}
 
-	err = c.server.UpdateUpstreamKeepalive(request.ClientKey, request.Address)
+	if request.ClientKey != "" && request.ClientKey != identity {
+		log.Printf("upstream %s sent a keepalive for %s, rejecting\n", identity, request.ClientKey)
+		return c.JSON(http.StatusForbidden, ApiError{ErrIdentityMismatch.Error()})
+	}
+
+	err = c.server.admitUpstream(cert)
+	if errors.Is(err, ErrNotAdmitted) {
+		log.Printf("upstream %s is not allowed to register itself, rejecting\n", identity)
+		return c.JSON(http.StatusForbidden, ApiError{err.Error()})
+	}
+
+	// RemoteAddr is the TCP peer, we never look at forwarding headers here
+	err = c.server.UpdateUpstreamKeepalive(identity, &request, c.Request().RemoteAddr, cert.NotAfter)
 
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, ApiError{err.Error()})
@@ -180,9 +468,35 @@ func upstreamKeepAlive(c TrackerContext) error {
 	return c.JSON(http.StatusOK, ApiError{})
 }
 
+// peerIdentity returns the CN of the verified client certificate, which is
+// the only upstream identity the tracker trusts
+func peerIdentity(c TrackerContext) (string, error) {
+	cert, err := peerCertificate(c)
+	if err != nil {
+		return "", err
+	}
+
+	return cert.Subject.CommonName, nil
+}
+
+func peerCertificate(c TrackerContext) (*x509.Certificate, error) {
+	state := c.Request().TLS
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil, ErrNoPeerCertificate
+	}
+
+	return state.VerifiedChains[0][0], nil
+}
+
 func getUpstreams(c TrackerContext) error {
-	c.server.upstreamLock.RLock()
-	defer c.server.upstreamLock.RUnlock()
+	return c.JSON(http.StatusOK, c.server.registry.snapshot().upstreams)
+}
+
+func getCRL(c TrackerContext) error {
+	crl := c.server.revocation.Raw()
+	if crl == nil {
+		return c.JSON(http.StatusNotFound, ApiError{"no CRL loaded"})
+	}
 
-	return c.JSON(http.StatusOK, c.server.upstreams)
+	return c.Blob(http.StatusOK, "application/pkix-crl", crl)
 }
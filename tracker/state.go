@@ -0,0 +1,195 @@
+package tracker
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const stateVersion = 1
+
+var ErrStateVersion = errors.New("unsupported state file version")
+
+// trackerState is what the tracker keeps across restarts. Connection counts
+// and circuit breakers are not saved, they start over.
+type trackerState struct {
+	Version   int
+	Saved     time.Time
+	Upstreams []persistedUpstream
+}
+
+type persistedUpstream struct {
+	Key               string
+	Address           string
+	AdvertisedAddress string
+	ObservedAddress   string
+	AddressHistory    []AddressChange
+	KeepAlive         time.Time
+	Enabled           bool
+	Draining          bool
+	AutoAdmitted      bool
+	// tags the upstream reported on top of the configured ones
+	ReportedTags      []string
+	Reachable         bool
+	LastProbe         *ProbeResult
+	Load              *UpstreamLoad
+	CertificateExpiry time.Time
+	Metrics           *metricsState
+}
+
+// SaveState writes the current registry to path, replacing it atomically
+func (ts *TrackerServer) SaveState(path string) error {
+	state := trackerState{
+		Version: stateVersion,
+		Saved:   time.Now(),
+	}
+
+	for _, upstream := range ts.registry.snapshot().upstreams {
+		state.Upstreams = append(state.Upstreams, persistedUpstream{
+			Key:               upstream.Key,
+			Address:           upstream.Address,
+			AdvertisedAddress: upstream.AdvertisedAddress,
+			ObservedAddress:   upstream.ObservedAddress,
+			AddressHistory:    upstream.AddressHistory,
+			KeepAlive:         upstream.KeepAlive,
+			Enabled:           upstream.Enabled,
+			Draining:          upstream.Draining,
+			AutoAdmitted:      upstream.AutoAdmitted,
+			ReportedTags:      upstream.reportedTags(),
+			Reachable:         upstream.Reachable,
+			LastProbe:         upstream.LastProbe,
+			Load:              upstream.Load,
+			CertificateExpiry: upstream.CertificateExpiry,
+			Metrics:           upstream.runtime.metrics.export(),
+		})
+	}
+
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return errors.Wrap(err, "could not encode tracker state")
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// PersistState saves the registry to path every interval while it changes
+func (ts *TrackerServer) PersistState(path string, interval time.Duration) {
+	var saved *snapshot
+
+	for {
+		time.Sleep(interval)
+
+		current := ts.registry.snapshot()
+		if current == saved {
+			continue
+		}
+
+		err := ts.SaveState(path)
+		if err != nil {
+			log.Printf("could not save tracker state: %s\n", err)
+			continue
+		}
+
+		saved = current
+	}
+}
+
+// restoreState loads the upstreams saved at path into the configured ones,
+// which include the keys file, and admits again the auto admitted ones the
+// current settings still let in. Upstreams whose deadline has not passed yet
+// are provisionally available until their next keepalive confirms them or
+// the reaper expires them.
+func (ts *TrackerServer) restoreState(path string, upstreams map[string]*Upstream, deadline time.Duration) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not read state at %s", path)
+	}
+
+	var state trackerState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return errors.Wrapf(err, "could not parse state at %s", path)
+	}
+
+	if state.Version != stateVersion {
+		return errors.Wrapf(ErrStateVersion, "got version %d", state.Version)
+	}
+
+	restored := 0
+
+	for _, saved := range state.Upstreams {
+		// upstreams removed from the config stay removed
+		upstream, ok := upstreams[saved.Key]
+		if !ok {
+			if !saved.AutoAdmitted || !ts.autoAdmits(saved.Key) {
+				continue
+			}
+
+			upstream = ts.newAdmittedUpstream(saved.Key)
+			upstreams[saved.Key] = upstream
+		}
+
+		upstream.Address = saved.Address
+		upstream.AdvertisedAddress = saved.AdvertisedAddress
+		upstream.ObservedAddress = saved.ObservedAddress
+		upstream.AddressHistory = saved.AddressHistory
+		upstream.KeepAlive = saved.KeepAlive
+		upstream.Enabled = saved.Enabled
+		upstream.Draining = saved.Draining
+		upstream.Tags = mergeTags(upstream.configTags, saved.ReportedTags)
+		// without probing nothing would ever make it reachable again
+		if ts.probing {
+			upstream.Reachable = saved.Reachable
+		}
+		upstream.LastProbe = saved.LastProbe
+		upstream.Load = saved.Load
+		upstream.CertificateExpiry = saved.CertificateExpiry
+
+		if saved.Metrics != nil {
+			upstream.runtime.metrics.restore(saved.Metrics)
+		}
+
+		upstream.Available = upstream.Address != "" && upstream.Reachable && upstream.IsAlive(deadline)
+		upstream.Provisional = upstream.Available
+
+		restored++
+	}
+
+	log.Printf("restored %d upstreams from state saved at %s\n", restored, state.Saved.Format(time.RFC3339))
+
+	return nil
+}
+
+// writeFileAtomic replaces path with data, so readers never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	fd, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return errors.Wrap(err, "could not create temporary file")
+	}
+	defer os.Remove(fd.Name())
+
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not write %s", fd.Name())
+	}
+
+	err = os.Rename(fd.Name(), path)
+	if err != nil {
+		return errors.Wrapf(err, "could not replace %s", path)
+	}
+
+	return nil
+}
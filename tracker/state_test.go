@@ -0,0 +1,150 @@
+package tracker
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ca0s/despiste/certificates"
+	"github.com/ca0s/despiste/config"
+)
+
+func TestStateRestore(t *testing.T) {
+	cfg := testConfig(3, 100*time.Millisecond)
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	sendKeepalive(t, ts, "upstream-0", 41000)
+	sendKeepalive(t, ts, "upstream-1", 41001)
+	ts.SetUpstreamState("upstream-1", UpstreamStateDisabled)
+
+	upstream, err := ts.GetUpstream(context.Background(), &SelectionRequest{Upstream: "upstream-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.ObserveHandshake(10 * time.Millisecond)
+	upstream.ConnectionClosed()
+
+	if err := ts.SaveState(cfg.StateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	restored := restarted.registry.snapshot().upstreams
+	if u := restored["upstream-0"]; !u.Available || !u.Provisional || u.Address != "127.0.0.1:41000" || u.Latency() != 10*time.Millisecond {
+		t.Errorf("upstream-0 not restored: %+v", u)
+	}
+	if u := restored["upstream-1"]; u.Enabled {
+		t.Error("disabled upstream enabled after restart")
+	}
+	if u := restored["upstream-2"]; u.Available {
+		t.Error("upstream without keepalives available after restart")
+	}
+
+	// usable before any keepalive reaches the new server
+	upstream, err = restarted.GetUpstream(context.Background(), &SelectionRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.ConnectionClosed()
+
+	sendKeepalive(t, restarted, "upstream-0", 41000)
+
+	if restarted.registry.snapshot().upstreams["upstream-0"].Provisional {
+		t.Error("upstream still provisional after a keepalive")
+	}
+
+	// unconfirmed upstreams expire at their original deadline
+	time.Sleep(150 * time.Millisecond)
+
+	if restarted.registry.snapshot().upstreams["upstream-1"].Available {
+		t.Error("unconfirmed upstream still available past its deadline")
+	}
+
+	checkConsistency(t, restarted)
+}
+
+func TestStateRestoreReachability(t *testing.T) {
+	cfg := testConfig(1, time.Minute)
+	cfg.StateFile = filepath.Join(t.TempDir(), "state.json")
+	cfg.ProbeInterval = time.Second
+
+	// saved before the upstream passed any probe
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	if err := ts.SaveState(cfg.StateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	if restarted.registry.snapshot().upstreams["upstream-0"].Available {
+		t.Error("unprobed upstream available after restart")
+	}
+
+	// nothing would probe it once probing is turned off
+	cfg.ProbeInterval = 0
+
+	restarted = newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	if u := restarted.registry.snapshot().upstreams["upstream-0"]; !u.Reachable || !u.Available {
+		t.Errorf("upstream unavailable after restarting without probing: %+v", u)
+	}
+}
+
+func TestStateRestoreAddedUpstreams(t *testing.T) {
+	dir := t.TempDir()
+
+	cfg := testConfig(0, time.Minute)
+	cfg.StateFile = filepath.Join(dir, "state.json")
+	cfg.UpstreamKeysFile = filepath.Join(dir, "upstreams.json")
+	cfg.AutoAdmitUpstreams = true
+	cfg.AutoAdmitPattern = "admitted-*"
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	if _, err := ts.AddUpstream(config.UpstreamConfig{Key: "added-0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.admitUpstream(testCertificate("admitted-0", certificates.RoleUpstream)); err != nil {
+		t.Fatal(err)
+	}
+
+	sendKeepalive(t, ts, "added-0", 41000)
+	sendKeepalive(t, ts, "admitted-0", 41001)
+	ts.SetUpstreamState("admitted-0", UpstreamStateDraining)
+
+	if err := ts.SaveState(cfg.StateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	restored := restarted.registry.snapshot().upstreams
+
+	if u, ok := restored["added-0"]; !ok || !u.Available || u.Address != "127.0.0.1:41000" {
+		t.Errorf("upstream from the keys file not restored: %+v", u)
+	}
+	if u, ok := restored["admitted-0"]; !ok || !u.Available || !u.AutoAdmitted || !u.Draining {
+		t.Errorf("auto admitted upstream not restored: %+v", u)
+	}
+
+	checkConsistency(t, restarted)
+
+	// admission settings that no longer let it in are applied on restore
+	cfg.AutoAdmitPattern = "other-*"
+
+	restarted = newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	if _, ok := restarted.registry.snapshot().upstreams["admitted-0"]; ok {
+		t.Error("restored an upstream auto admission no longer allows")
+	}
+
+	cfg.AutoAdmitUpstreams = false
+	cfg.AutoAdmitPattern = ""
+
+	restarted = newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	if _, ok := restarted.registry.snapshot().upstreams["admitted-0"]; ok {
+		t.Error("restored an auto admitted upstream with auto admission disabled")
+	}
+}
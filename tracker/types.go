@@ -1,8 +1,34 @@
 package tracker
 
 type KeepAliveRequest struct {
-	ClientKey string `json:"client_key"`
-	Address   string `json:"address"`
+	ClientKey string        `json:"client_key"`
+	Address   string        `json:"address"`
+	Tags      []string      `json:"tags"`
+	Load      *UpstreamLoad `json:"load,omitempty"`
+}
+
+type UpstreamLoad struct {
+	ActiveConnections int64 `json:"active_connections"`
+	// bytes relayed since the previous keepalive
+	BytesRelayed int64 `json:"bytes_relayed"`
+	Goroutines   int   `json:"goroutines"`
+	// most connections the upstream is willing to handle, 0 for no limit
+	Capacity int64 `json:"capacity"`
+}
+
+type LoadSource interface {
+	Load() UpstreamLoad
+}
+
+type EnrollmentRequest struct {
+	Token string `json:"token"`
+	// PEM encoded, for an ECDSA P-256 key
+	CSR string `json:"csr"`
+}
+
+type EnrollmentResponse struct {
+	// PEM encoded certificate followed by the signer's
+	Certificate string `json:"certificate"`
 }
 
 type ApiError struct {
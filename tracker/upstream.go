@@ -1,17 +1,282 @@
 package tracker
 
 import (
+	"encoding/json"
+	"slices"
+	"sync/atomic"
 	"time"
+
+	"github.com/ca0s/despiste/config"
 )
 
+const AddressHistoryLength = 10
+
 type Upstream struct {
 	Address   string
 	Key       string
 	KeepAlive time.Time
 	Enabled   bool
+	Draining  bool
 	Available bool
+	// restored from the state file and not confirmed by a keepalive yet
+	Provisional bool
+	Weight      int
+	Tags        []string
+
+	// most concurrent connections from this server, 0 for the capacity the
+	// upstream reports
+	MaxConnections int64
+
+	UseSourceAddress bool
+	// registered by its certificate role instead of the config
+	AutoAdmitted      bool
+	AdvertisedAddress string
+	ObservedAddress   string
+	AddressHistory    []AddressChange
+
+	// false while the server's health probes cannot reach the upstream
+	Reachable bool
+	LastProbe *ProbeResult
+
+	// as reported in the last keepalive
+	Load *UpstreamLoad
+	// of the certificate the upstream sends its keepalives with
+	CertificateExpiry time.Time
+
+	configTags []string
+	runtime    *upstreamRuntime
+}
+
+// upstreamRuntime is the state shared by every version of an upstream
+type upstreamRuntime struct {
+	breaker  *CircuitBreaker
+	released *broadcaster
+
+	activeConnections int64
+	metrics           upstreamMetrics
+}
+
+type AddressChange struct {
+	Address string
+	Time    time.Time
+}
+
+// NewUpstream returns an enabled upstream reachable at address, for callers
+// without a tracker
+func NewUpstream(key string, address string) *Upstream {
+	return &Upstream{
+		Address:   address,
+		Key:       key,
+		Enabled:   true,
+		Available: true,
+		Reachable: true,
+		runtime:   &upstreamRuntime{},
+	}
+}
+
+// clone returns a new version of the upstream sharing its runtime state.
+// Versions published by the registry are never modified.
+func (u *Upstream) clone() *Upstream {
+	c := *u
+	return &c
+}
+
+func (u *Upstream) breaker() *CircuitBreaker {
+	return u.runtime.breaker
 }
 
 func (u *Upstream) IsAlive(d time.Duration) bool {
 	return u.KeepAlive.After(time.Now().Add(-d))
 }
+
+func (u *Upstream) state() *UpstreamState {
+	state := &UpstreamState{
+		Key:               u.Key,
+		State:             UpstreamStateEnabled,
+		Available:         u.Available,
+		ActiveConnections: u.ActiveConnections(),
+	}
+
+	switch {
+	case u.Draining:
+		state.State = UpstreamStateDraining
+		state.Drained = state.ActiveConnections == 0
+	case !u.Enabled:
+		state.State = UpstreamStateDisabled
+	}
+
+	return state
+}
+
+func (u *Upstream) HasTags(tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(u.Tags, tag) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Saturated reports whether the upstream declared it is at its capacity
+func (u *Upstream) Saturated() bool {
+	return u.Load != nil && u.Load.Capacity > 0 && u.Load.ActiveConnections >= u.Load.Capacity
+}
+
+func (u *Upstream) EffectiveWeight() int {
+	if u.Weight <= 0 {
+		return 1
+	}
+
+	return u.Weight
+}
+
+func (u *Upstream) HasCapacity() bool {
+	if u.Saturated() {
+		return false
+	}
+
+	limit := u.connectionLimit()
+	return limit <= 0 || u.ActiveConnections() < limit
+}
+
+func (u *Upstream) connectionLimit() int64 {
+	if u.MaxConnections > 0 {
+		return u.MaxConnections
+	}
+
+	if u.Load != nil {
+		return u.Load.Capacity
+	}
+
+	return 0
+}
+
+// reserveConnection takes a connection slot unless limit is reached
+func (u *Upstream) reserveConnection(limit int64) bool {
+	for {
+		active := atomic.LoadInt64(&u.runtime.activeConnections)
+		if limit > 0 && active >= limit {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(&u.runtime.activeConnections, active, active+1) {
+			return true
+		}
+	}
+}
+
+// ConnectionOpened takes a connection slot regardless of any limit
+func (u *Upstream) ConnectionOpened() {
+	atomic.AddInt64(&u.runtime.activeConnections, 1)
+}
+
+// ConnectionClosed releases a connection slot, waking up queued requests
+func (u *Upstream) ConnectionClosed() {
+	atomic.AddInt64(&u.runtime.activeConnections, -1)
+	u.runtime.released.notify()
+}
+
+func (u *Upstream) ActiveConnections() int64 {
+	return atomic.LoadInt64(&u.runtime.activeConnections)
+}
+
+// DialSucceeded, DialFailed and DialAborted report the outcome of a dial
+// through the upstream to its circuit breaker
+func (u *Upstream) DialSucceeded() {
+	u.breaker().Success()
+}
+
+func (u *Upstream) DialFailed() {
+	u.breaker().Failure()
+}
+
+func (u *Upstream) DialAborted() {
+	u.breaker().Abort()
+}
+
+// ObserveHandshake, ObserveConnect and ObserveTransfer feed measurements of
+// real traffic through the upstream: the TLS handshake, the socks CONNECT to
+// the destination and the bytes moved by a finished connection
+func (u *Upstream) ObserveHandshake(d time.Duration) {
+	u.runtime.metrics.observeHandshake(d)
+}
+
+func (u *Upstream) ObserveConnect(d time.Duration) {
+	u.runtime.metrics.observeConnect(d)
+}
+
+func (u *Upstream) ObserveTransfer(sent int64, received int64, d time.Duration) {
+	u.runtime.metrics.observeTransfer(sent, received, d)
+}
+
+// Latency is the median time to get a connection through the upstream
+func (u *Upstream) Latency() time.Duration {
+	return u.runtime.metrics.latency()
+}
+
+func (u *Upstream) Metrics() UpstreamMetrics {
+	return u.runtime.metrics.snapshot()
+}
+
+func (u *Upstream) MarshalJSON() ([]byte, error) {
+	type plainUpstream Upstream
+
+	return json.Marshal(struct {
+		*plainUpstream
+		ActiveConnections int64
+		Latency           time.Duration
+		Metrics           UpstreamMetrics
+		Breaker           BreakerStatus
+	}{
+		plainUpstream:     (*plainUpstream)(u),
+		ActiveConnections: u.ActiveConnections(),
+		Latency:           u.Latency(),
+		Metrics:           u.Metrics(),
+		Breaker:           u.breaker().Status(),
+	})
+}
+
+func (u *Upstream) setAddress(address string, t time.Time) {
+	if address == u.Address {
+		return
+	}
+
+	u.Address = address
+	u.AddressHistory = append(u.AddressHistory, AddressChange{Address: address, Time: t})
+
+	if len(u.AddressHistory) > AddressHistoryLength {
+		u.AddressHistory = u.AddressHistory[len(u.AddressHistory)-AddressHistoryLength:]
+	}
+}
+
+// applyConfig updates the settings that come from the server's config
+func (u *Upstream) applyConfig(upstreamConfig config.UpstreamConfig) {
+	u.Tags = mergeTags(upstreamConfig.Tags, u.reportedTags())
+	u.configTags = upstreamConfig.Tags
+	u.Weight = upstreamConfig.Weight
+	u.MaxConnections = upstreamConfig.MaxConnections
+	u.UseSourceAddress = upstreamConfig.UseSourceAddress
+}
+
+// reportedTags returns the tags the upstream reported on top of the
+// configured ones
+func (u *Upstream) reportedTags() []string {
+	return slices.DeleteFunc(slices.Clone(u.Tags), func(tag string) bool {
+		return slices.Contains(u.configTags, tag)
+	})
+}
+
+// mergeTags returns the union of the tags configured on the server and the
+// ones reported by the upstream
+func mergeTags(configured []string, reported []string) []string {
+	tags := append([]string{}, configured...)
+
+	for _, tag := range reported {
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
@@ -0,0 +1,377 @@
+package tracker
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ca0s/despiste/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	WebhookUpstreamUp          = "upstream_up"
+	WebhookUpstreamDown        = "upstream_down"
+	WebhookUpstreamFlapping    = "upstream_flapping"
+	WebhookCertificateExpiring = "certificate_expiring"
+	WebhookNoUpstreams         = "no_upstreams_available"
+)
+
+const webhookQueueLength = 100
+const webhookTimeout = 10 * time.Second
+const certificateCheckInterval = time.Hour
+
+type WebhookEvent struct {
+	Event    string    `json:"event"`
+	Upstream string    `json:"upstream,omitempty"`
+	Address  string    `json:"address,omitempty"`
+	Time     time.Time `json:"time"`
+	Message  string    `json:"message"`
+}
+
+type webhookTarget struct {
+	config config.WebhookConfig
+	queue  chan WebhookEvent
+}
+
+type webhookStatusError struct {
+	code int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("webhook response: %d", e.code)
+}
+
+// WebhookNotifier turns upstream state changes into webhook calls. Upstreams
+// changing state too often are reported as flapping once per window instead
+// of on every change, and their state is sent again once they settle.
+type WebhookNotifier struct {
+	targets    []*webhookTarget
+	httpClient *http.Client
+
+	retries           int
+	backoff           time.Duration
+	flapThreshold     int
+	flapWindow        time.Duration
+	certExpiryWarning time.Duration
+	certificates      []*x509.Certificate
+
+	// only used from Run
+	transitions   map[string][]time.Time
+	flappingUntil map[string]time.Time
+	warned        map[string]struct{}
+	noUpstreams   bool
+}
+
+func NewWebhookNotifier(cfg *config.Config) *WebhookNotifier {
+	n := &WebhookNotifier{
+		httpClient: &http.Client{
+			Timeout: webhookTimeout,
+		},
+
+		retries:           cfg.WebhookRetries,
+		backoff:           cfg.WebhookBackoff,
+		flapThreshold:     cfg.FlapThreshold,
+		flapWindow:        cfg.FlapWindow,
+		certExpiryWarning: cfg.CertExpiryWarning,
+
+		transitions:   make(map[string][]time.Time),
+		flappingUntil: make(map[string]time.Time),
+		warned:        make(map[string]struct{}),
+	}
+
+	for _, cert := range []*x509.Certificate{cfg.Cert, cfg.CACert} {
+		if cert != nil {
+			n.certificates = append(n.certificates, cert)
+		}
+	}
+
+	for _, webhook := range cfg.Webhooks {
+		n.targets = append(n.targets, &webhookTarget{
+			config: webhook,
+			queue:  make(chan WebhookEvent, webhookQueueLength),
+		})
+	}
+
+	return n
+}
+
+// Start subscribes to the events of the tracker server and delivers them in
+// the background
+func (n *WebhookNotifier) Start(ts *TrackerServer) {
+	for _, target := range n.targets {
+		go n.deliver(target)
+	}
+
+	events, _ := ts.Subscribe(webhookQueueLength)
+
+	go n.run(ts, events)
+}
+
+func (n *WebhookNotifier) run(ts *TrackerServer, events <-chan Event) {
+	ticker := time.NewTicker(certificateCheckInterval)
+	defer ticker.Stop()
+
+	// fires when the earliest flapping window closes
+	settleTimer := time.NewTimer(time.Hour)
+	settleTimer.Stop()
+
+	n.checkCertificates(ts, time.Now())
+
+	for {
+		select {
+		case event := <-events:
+			n.handle(ts, event)
+		case now := <-ticker.C:
+			n.checkCertificates(ts, now)
+		case now := <-settleTimer.C:
+			n.settle(ts, now)
+		}
+
+		n.resetSettleTimer(settleTimer)
+	}
+}
+
+func (n *WebhookNotifier) handle(ts *TrackerServer, event Event) {
+	var webhookEvent string
+
+	switch event.Type {
+	case EventAvailable:
+		webhookEvent = WebhookUpstreamUp
+	case EventUnavailable:
+		webhookEvent = WebhookUpstreamDown
+	default:
+		return
+	}
+
+	if !n.flapping(event) {
+		n.sendState(webhookEvent, event.Key, event.Address, event.Time, fmt.Sprintf("upstream %s is %s", event.Key, event.Type))
+	}
+
+	// a flapping upstream can still be the last one to go
+	if event.Type == EventUnavailable && !n.noUpstreams && lastUpstream(ts.registry.snapshot(), event.Key) {
+		n.noUpstreams = true
+		n.send(WebhookEvent{
+			Event:   WebhookNoUpstreams,
+			Time:    event.Time,
+			Message: "no upstreams are available",
+		})
+	}
+}
+
+// sendState sends an upstream_up or upstream_down event. Only an up event that
+// is actually sent re-arms no_upstreams_available, so a flapping upstream does
+// not repeat it on every change.
+func (n *WebhookNotifier) sendState(webhookEvent string, key string, address string, now time.Time, message string) {
+	if webhookEvent == WebhookUpstreamUp {
+		n.noUpstreams = false
+	}
+
+	n.send(WebhookEvent{
+		Event:    webhookEvent,
+		Upstream: key,
+		Address:  address,
+		Time:     now,
+		Message:  message,
+	})
+}
+
+// lastUpstream tells whether no upstream other than key is available. The
+// snapshot may already be newer than the event being handled, key counts as
+// down until its own up event arrives.
+func lastUpstream(snapshot *snapshot, key string) bool {
+	for _, upstream := range snapshot.available {
+		if upstream.Key != key {
+			return false
+		}
+	}
+
+	return true
+}
+
+// resetSettleTimer sets timer to the end of the earliest flapping window, or
+// leaves it stopped if no upstream is flapping. The timer must not be read
+// from anywhere else, as it is drained before being reset.
+func (n *WebhookNotifier) resetSettleTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+
+	var earliest time.Time
+	for _, until := range n.flappingUntil {
+		if earliest.IsZero() || until.Before(earliest) {
+			earliest = until
+		}
+	}
+
+	if !earliest.IsZero() {
+		timer.Reset(time.Until(earliest))
+	}
+}
+
+// settle sends the current state of the upstreams whose flapping window has
+// closed, as the changes during the window were not sent
+func (n *WebhookNotifier) settle(ts *TrackerServer, now time.Time) {
+	snapshot := ts.registry.snapshot()
+
+	for key, until := range n.flappingUntil {
+		if now.Before(until) {
+			continue
+		}
+
+		delete(n.flappingUntil, key)
+		delete(n.transitions, key)
+
+		webhookEvent, state, address := WebhookUpstreamDown, EventUnavailable, ""
+		if upstream, ok := snapshot.upstreams[key]; ok {
+			address = upstream.Address
+			if upstream.Available {
+				webhookEvent, state = WebhookUpstreamUp, EventAvailable
+			}
+		}
+
+		n.sendState(webhookEvent, key, address, now, fmt.Sprintf("upstream %s is %s after flapping", key, state))
+	}
+}
+
+// flapping records a state change and reports whether the upstream is
+// flapping, sending the flapping event when it starts
+func (n *WebhookNotifier) flapping(event Event) bool {
+	if n.flapThreshold <= 0 {
+		return false
+	}
+
+	since := event.Time.Add(-n.flapWindow)
+
+	transitions := append(n.transitions[event.Key], event.Time)
+	for len(transitions) > 0 && transitions[0].Before(since) {
+		transitions = transitions[1:]
+	}
+	n.transitions[event.Key] = transitions
+
+	if event.Time.Before(n.flappingUntil[event.Key]) {
+		n.flappingUntil[event.Key] = event.Time.Add(n.flapWindow)
+		return true
+	}
+
+	if len(transitions) < n.flapThreshold {
+		return false
+	}
+
+	n.flappingUntil[event.Key] = event.Time.Add(n.flapWindow)
+	n.send(WebhookEvent{
+		Event:    WebhookUpstreamFlapping,
+		Upstream: event.Key,
+		Address:  event.Address,
+		Time:     event.Time,
+		Message:  fmt.Sprintf("upstream %s changed state %d times in %s", event.Key, len(transitions), n.flapWindow),
+	})
+
+	return true
+}
+
+// checkCertificates warns once about each certificate of the server, its CA
+// and its upstreams expiring soon
+func (n *WebhookNotifier) checkCertificates(ts *TrackerServer, now time.Time) {
+	warn := func(name string, upstream string, expiry time.Time) {
+		if expiry.IsZero() || expiry.Sub(now) > n.certExpiryWarning {
+			return
+		}
+
+		id := name + "|" + expiry.String()
+		if _, ok := n.warned[id]; ok {
+			return
+		}
+		n.warned[id] = struct{}{}
+
+		n.send(WebhookEvent{
+			Event:    WebhookCertificateExpiring,
+			Upstream: upstream,
+			Time:     now,
+			Message:  fmt.Sprintf("certificate %s expires at %s", name, expiry.Format(time.RFC3339)),
+		})
+	}
+
+	for _, cert := range n.certificates {
+		warn(cert.Subject.CommonName, "", cert.NotAfter)
+	}
+
+	ts.registry.view(func(upstreams map[string]*Upstream) {
+		for _, upstream := range upstreams {
+			warn(upstream.Key, upstream.Key, upstream.CertificateExpiry)
+		}
+	})
+}
+
+func (n *WebhookNotifier) send(event WebhookEvent) {
+	for _, target := range n.targets {
+		if len(target.config.Events) > 0 && !slices.Contains(target.config.Events, event.Event) {
+			continue
+		}
+
+		select {
+		case target.queue <- event:
+		default:
+			log.Printf("webhook queue for %s is full, dropping %s event\n", target.config.URL, event.Event)
+		}
+	}
+}
+
+func (n *WebhookNotifier) deliver(target *webhookTarget) {
+	for event := range target.queue {
+		body, err := json.Marshal(&event)
+		if err != nil {
+			log.Printf("could not encode webhook event: %s\n", err)
+			continue
+		}
+
+		for attempt := 0; ; attempt++ {
+			err = n.post(target.config.URL, body)
+			if err == nil {
+				break
+			}
+
+			if attempt >= n.retries || !retryableWebhookError(err) {
+				log.Printf("giving up on %s webhook to %s: %s\n", event.Event, target.config.URL, err)
+				break
+			}
+
+			time.Sleep(n.backoff << attempt)
+		}
+	}
+}
+
+func (n *WebhookNotifier) post(url string, body []byte) error {
+	response, err := n.httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "could not send webhook")
+	}
+
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &webhookStatusError{code: response.StatusCode}
+	}
+
+	return nil
+}
+
+// retryableWebhookError is false for requests the receiver rejected as invalid
+func retryableWebhookError(err error) bool {
+	var statusErr *webhookStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+
+	return statusErr.code == http.StatusTooManyRequests || statusErr.code >= 500
+}
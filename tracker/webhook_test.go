@@ -0,0 +1,234 @@
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ca0s/despiste/config"
+)
+
+type receivedWebhook struct {
+	path  string
+	event WebhookEvent
+}
+
+// newWebhookReceiver answers the first failures requests with a server error
+func newWebhookReceiver(t *testing.T, failures int32) (*httptest.Server, <-chan receivedWebhook, *atomic.Int32) {
+	received := make(chan receivedWebhook, 16)
+	attempts := &atomic.Int32{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		received <- receivedWebhook{path: r.URL.Path, event: event}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, received, attempts
+}
+
+func webhookConfig(urls ...string) *config.Config {
+	cfg := testConfig(1, time.Minute)
+	cfg.ProbeInterval = time.Second
+	cfg.WebhookRetries = 2
+	cfg.WebhookBackoff = time.Millisecond
+	cfg.FlapThreshold = 10
+	cfg.FlapWindow = time.Minute
+	cfg.CertExpiryWarning = time.Minute
+
+	for _, url := range urls {
+		cfg.Webhooks = append(cfg.Webhooks, config.WebhookConfig{URL: url})
+	}
+
+	return cfg
+}
+
+func nextWebhook(t *testing.T, received <-chan receivedWebhook) receivedWebhook {
+	t.Helper()
+
+	select {
+	case webhook := <-received:
+		return webhook
+	case <-time.After(time.Second):
+		t.Fatal("no webhook received")
+	}
+
+	return receivedWebhook{}
+}
+
+func expectWebhooks(t *testing.T, received <-chan receivedWebhook, events ...string) {
+	t.Helper()
+
+	for _, event := range events {
+		if webhook := nextWebhook(t, received); webhook.event.Event != event {
+			t.Fatalf("expected %s webhook, got %+v", event, webhook.event)
+		}
+	}
+
+	select {
+	case webhook := <-received:
+		t.Fatalf("unexpected webhook %+v", webhook.event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookNotifications(t *testing.T) {
+	server, received, attempts := newWebhookReceiver(t, 1)
+
+	cfg := webhookConfig(server.URL)
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	NewWebhookNotifier(cfg).Start(ts)
+
+	sendKeepalive(t, ts, "upstream-0", 41000)
+	ts.ReportProbe("upstream-0", nil)
+
+	webhook := nextWebhook(t, received)
+	if webhook.event.Event != WebhookUpstreamUp || webhook.event.Upstream != "upstream-0" || webhook.event.Address != "127.0.0.1:41000" {
+		t.Errorf("unexpected webhook %+v", webhook.event)
+	}
+
+	if attempts.Load() != 2 {
+		t.Errorf("failed delivery was not retried, %d attempts", attempts.Load())
+	}
+
+	ts.ReportProbe("upstream-0", errors.New("probe failed"))
+
+	expectWebhooks(t, received, WebhookUpstreamDown, WebhookNoUpstreams)
+}
+
+func TestWebhookFlapping(t *testing.T) {
+	server, received, _ := newWebhookReceiver(t, 0)
+
+	cfg := webhookConfig(server.URL+"/all", server.URL+"/flapping")
+	cfg.FlapThreshold = 3
+	cfg.Webhooks[1].Events = []string{WebhookUpstreamFlapping}
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	NewWebhookNotifier(cfg).Start(ts)
+
+	sendKeepalive(t, ts, "upstream-0", 41000)
+	for i := 0; i < 3; i++ {
+		ts.ReportProbe("upstream-0", nil)
+		ts.ReportProbe("upstream-0", errors.New("probe failed"))
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		webhook := nextWebhook(t, received)
+		counts[webhook.path+" "+webhook.event.Event]++
+	}
+
+	expected := map[string]int{
+		"/all " + WebhookUpstreamUp:            1,
+		"/all " + WebhookUpstreamDown:          1,
+		"/all " + WebhookUpstreamFlapping:      1,
+		"/flapping " + WebhookUpstreamFlapping: 1,
+		"/all " + WebhookNoUpstreams:           1,
+	}
+	for key, count := range expected {
+		if counts[key] != count {
+			t.Errorf("got %d %s webhooks, expected %d", counts[key], key, count)
+		}
+	}
+
+	expectWebhooks(t, received)
+}
+
+func TestWebhookFlappingSettles(t *testing.T) {
+	server, received, _ := newWebhookReceiver(t, 0)
+
+	cfg := webhookConfig(server.URL)
+	cfg.Upstreams = testConfig(2, time.Minute).Upstreams
+	cfg.FlapThreshold = 3
+	cfg.FlapWindow = 300 * time.Millisecond
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	NewWebhookNotifier(cfg).Start(ts)
+
+	sendKeepalive(t, ts, "upstream-0", 41000)
+	sendKeepalive(t, ts, "upstream-1", 41001)
+
+	// one change at a time, the notifier checks availability when it gets them
+	ts.ReportProbe("upstream-0", nil)
+	ts.ReportProbe("upstream-1", nil)
+	expectWebhooks(t, received, WebhookUpstreamUp, WebhookUpstreamUp)
+
+	ts.ReportProbe("upstream-0", errors.New("probe failed"))
+	expectWebhooks(t, received, WebhookUpstreamDown)
+
+	ts.ReportProbe("upstream-0", nil)
+	expectWebhooks(t, received, WebhookUpstreamFlapping)
+
+	ts.ReportProbe("upstream-1", errors.New("probe failed"))
+	expectWebhooks(t, received, WebhookUpstreamDown)
+
+	// the flapping upstream is the last one to go, and stays down
+	ts.ReportProbe("upstream-0", errors.New("probe failed"))
+	expectWebhooks(t, received, WebhookNoUpstreams)
+
+	webhook := nextWebhook(t, received)
+	if webhook.event.Event != WebhookUpstreamDown || webhook.event.Upstream != "upstream-0" {
+		t.Errorf("unexpected webhook %+v", webhook.event)
+	}
+}
+
+func TestWebhookNoUpstreamsFromEvents(t *testing.T) {
+	server, received, _ := newWebhookReceiver(t, 0)
+
+	cfg := webhookConfig(server.URL)
+	cfg.Upstreams = testConfig(2, time.Minute).Upstreams
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+
+	for i, key := range []string{"upstream-0", "upstream-1"} {
+		sendKeepalive(t, ts, key, 41000+i)
+		ts.ReportProbe(key, nil)
+	}
+
+	// subscribed like Start does, the notifier is left running
+	events, _ := ts.Subscribe(16)
+
+	// every upstream goes down and one comes back before the notifier gets
+	// to the events, so the snapshot it sees is newer than them
+	ts.ReportProbe("upstream-0", errors.New("probe failed"))
+	ts.ReportProbe("upstream-1", errors.New("probe failed"))
+	ts.ReportProbe("upstream-1", nil)
+
+	n := NewWebhookNotifier(cfg)
+	go n.deliver(n.targets[0])
+	go n.run(ts, events)
+
+	expectWebhooks(t, received, WebhookUpstreamDown, WebhookUpstreamDown, WebhookNoUpstreams, WebhookUpstreamUp)
+}
+
+func TestWebhookCertificateExpiry(t *testing.T) {
+	server, received, _ := newWebhookReceiver(t, 0)
+
+	cfg := webhookConfig(server.URL)
+	cfg.CertExpiryWarning = 2 * time.Hour
+
+	ts := newTestServer(t, cfg, SelectorRoundRobin, AffinityNone)
+	sendKeepalive(t, ts, "upstream-0", 41000)
+
+	NewWebhookNotifier(cfg).Start(ts)
+
+	webhook := nextWebhook(t, received)
+	if webhook.event.Event != WebhookCertificateExpiring || webhook.event.Upstream != "upstream-0" {
+		t.Errorf("unexpected webhook %+v", webhook.event)
+	}
+}
@@ -0,0 +1,74 @@
+package tracker
+
+import "sync"
+
+// WeightedRoundRobin implements the smooth weighted round robin used by
+// nginx, which interleaves upstreams instead of sending bursts to the
+// heaviest one. The running weights are shared state, so unlike the other
+// selectors it takes a lock.
+type WeightedRoundRobin struct {
+	lock    sync.Mutex
+	current map[string]int
+}
+
+func NewWeightedRoundRobin() *WeightedRoundRobin {
+	return &WeightedRoundRobin{
+		current: make(map[string]int),
+	}
+}
+
+func (w *WeightedRoundRobin) Next(upstreams []*Upstream, filter UpstreamFilter) *Upstream {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.prune(upstreams)
+
+	var best *Upstream
+	total := 0
+
+	for _, u := range upstreams {
+		if !filter.Accepts(u) {
+			continue
+		}
+
+		weight := u.EffectiveWeight()
+		total += weight
+		w.current[u.Key] += weight
+
+		if best == nil || w.current[u.Key] > w.current[best.Key] {
+			best = u
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+
+	w.current[best.Key] -= total
+
+	return best
+}
+
+// prune drops the running weights of upstreams that are no longer available,
+// so removed and expired upstreams do not accumulate
+func (w *WeightedRoundRobin) prune(upstreams []*Upstream) {
+	known := 0
+	for _, u := range upstreams {
+		if _, ok := w.current[u.Key]; ok {
+			known++
+		}
+	}
+
+	if known == len(w.current) {
+		return
+	}
+
+	current := make(map[string]int, len(upstreams))
+	for _, u := range upstreams {
+		if weight, ok := w.current[u.Key]; ok {
+			current[u.Key] = weight
+		}
+	}
+
+	w.current = current
+}